@@ -0,0 +1,213 @@
+package ast
+
+// Copy : return a deep copy of node, so the copy can be passed to Modify without changing the original tree
+func Copy(node Node) Node {
+	switch node := node.(type) {
+	case *Program:
+		c := *node
+		c.Statements = copyStatements(node.Statements)
+		return &c
+	case *BlockStatement:
+		if node == nil {
+			return node
+		}
+		c := *node
+		c.Statements = copyStatements(node.Statements)
+		return &c
+	case *ExpressionStatement:
+		c := *node
+		c.Expression = copyExpression(node.Expression)
+		return &c
+	case *LetStatement:
+		c := *node
+		c.Name = copyIdentifier(node.Name)
+		c.Pattern = copyPattern(node.Pattern)
+		c.Value = copyExpression(node.Value)
+		return &c
+	case *ArrayPattern:
+		c := *node
+		c.Elements = make([]Pattern, len(node.Elements))
+		for i, el := range node.Elements {
+			c.Elements[i] = copyPattern(el)
+		}
+		c.Rest = copyIdentifier(node.Rest)
+		return &c
+	case *HashPattern:
+		c := *node
+		c.Keys = copyIdentifiers(node.Keys)
+		c.Values = make([]Pattern, len(node.Values))
+		for i, value := range node.Values {
+			c.Values[i] = copyPattern(value)
+		}
+		return &c
+	case *ReturnStatement:
+		c := *node
+		c.ReturnValue = copyExpression(node.ReturnValue)
+		return &c
+	case *ThrowStatement:
+		c := *node
+		c.Value = copyExpression(node.Value)
+		return &c
+	case *WhileStatement:
+		c := *node
+		c.Condition = copyExpression(node.Condition)
+		c.Body = copyBlock(node.Body)
+		return &c
+	case *ForStatement:
+		c := *node
+		c.Variable = copyIdentifier(node.Variable)
+		c.Iterable = copyExpression(node.Iterable)
+		c.Body = copyBlock(node.Body)
+		return &c
+	case *BreakStatement:
+		c := *node
+		return &c
+	case *ContinueStatement:
+		c := *node
+		return &c
+	case *Identifier:
+		return copyIdentifier(node)
+	case *IntegerLiteral:
+		c := *node
+		return &c
+	case *FloatLiteral:
+		c := *node
+		return &c
+	case *StringLiteral:
+		c := *node
+		return &c
+	case *Boolean:
+		c := *node
+		return &c
+	case *PrefixExpression:
+		c := *node
+		c.Right = copyExpression(node.Right)
+		return &c
+	case *InfixExpression:
+		c := *node
+		c.Left = copyExpression(node.Left)
+		c.Right = copyExpression(node.Right)
+		return &c
+	case *IndexExpression:
+		c := *node
+		c.Left = copyExpression(node.Left)
+		c.Index = copyExpression(node.Index)
+		return &c
+	case *AssignExpression:
+		c := *node
+		c.Target = copyExpression(node.Target)
+		c.Value = copyExpression(node.Value)
+		return &c
+	case *IfExpression:
+		c := *node
+		c.Condition = copyExpression(node.Condition)
+		c.Consequence = copyBlock(node.Consequence)
+		c.Alternative = copyBlock(node.Alternative)
+		return &c
+	case *TryExpression:
+		c := *node
+		c.Body = copyBlock(node.Body)
+		c.Param = copyIdentifier(node.Param)
+		c.Catch = copyBlock(node.Catch)
+		c.Finally = copyBlock(node.Finally)
+		return &c
+	case *FunctionLiteral:
+		c := *node
+		c.Parameters = copyIdentifiers(node.Parameters)
+		c.Defaults = copyExpressions(node.Defaults)
+		c.Rest = copyIdentifier(node.Rest)
+		c.Body = copyBlock(node.Body)
+		return &c
+	case *MacroLiteral:
+		c := *node
+		c.Parameters = copyIdentifiers(node.Parameters)
+		c.Body = copyBlock(node.Body)
+		return &c
+	case *CallExpression:
+		c := *node
+		c.Function = copyExpression(node.Function)
+		c.Arguments = copyExpressions(node.Arguments)
+		return &c
+	case *ArrayLiteral:
+		c := *node
+		c.Elements = copyExpressions(node.Elements)
+		return &c
+	case *HashLiteral:
+		c := *node
+		c.Pairs = make(map[Expression]Expression, len(node.Pairs))
+		for key, val := range node.Pairs {
+			c.Pairs[copyExpression(key)] = copyExpression(val)
+		}
+		return &c
+	}
+
+	return node
+}
+
+func copyStatements(stmts []Statement) []Statement {
+	if stmts == nil {
+		return nil
+	}
+
+	c := make([]Statement, len(stmts))
+	for i, s := range stmts {
+		c[i], _ = Copy(s).(Statement)
+	}
+	return c
+}
+
+func copyExpressions(exps []Expression) []Expression {
+	if exps == nil {
+		return nil
+	}
+
+	c := make([]Expression, len(exps))
+	for i, e := range exps {
+		c[i] = copyExpression(e)
+	}
+	return c
+}
+
+func copyIdentifiers(idents []*Identifier) []*Identifier {
+	if idents == nil {
+		return nil
+	}
+
+	c := make([]*Identifier, len(idents))
+	for i, ident := range idents {
+		c[i] = copyIdentifier(ident)
+	}
+	return c
+}
+
+func copyExpression(exp Expression) Expression {
+	if exp == nil {
+		return nil
+	}
+	c, _ := Copy(exp).(Expression)
+	return c
+}
+
+func copyPattern(pattern Pattern) Pattern {
+	if pattern == nil {
+		return nil
+	}
+	c, _ := Copy(pattern).(Pattern)
+	return c
+}
+
+func copyBlock(block *BlockStatement) *BlockStatement {
+	if block == nil {
+		return nil
+	}
+	c, _ := Copy(block).(*BlockStatement)
+	return c
+}
+
+func copyIdentifier(ident *Identifier) *Identifier {
+	if ident == nil {
+		return nil
+	}
+	c := *ident
+	return &c
+}
@@ -0,0 +1,81 @@
+package ast
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	one := func() Expression { return &IntegerLiteral{Value: 1} }
+
+	tests := []Node{
+		&Program{Statements: []Statement{&ExpressionStatement{Expression: one()}}},
+		&InfixExpression{Left: one(), Operator: "+", Right: one()},
+		&PrefixExpression{Operator: "-", Right: one()},
+		&IndexExpression{Left: one(), Index: one()},
+		&IfExpression{
+			Condition: one(),
+			Consequence: &BlockStatement{
+				Statements: []Statement{&ExpressionStatement{Expression: one()}},
+			},
+		},
+		&ReturnStatement{ReturnValue: one()},
+		&LetStatement{Name: &Identifier{Value: "x"}, Value: one()},
+		&LetStatement{
+			Pattern: &ArrayPattern{
+				Elements: []Pattern{
+					&Identifier{Value: "a"},
+					&HashPattern{Keys: []*Identifier{{Value: "b"}}, Values: []Pattern{&Identifier{Value: "c"}}},
+				},
+				Rest: &Identifier{Value: "rest"},
+			},
+			Value: one(),
+		},
+		&FunctionLiteral{
+			Parameters: []*Identifier{{Value: "a"}},
+			Body: &BlockStatement{
+				Statements: []Statement{&ExpressionStatement{Expression: one()}},
+			},
+		},
+		&FunctionLiteral{
+			Parameters: []*Identifier{{Value: "a"}, {Value: "b"}},
+			Defaults:   []Expression{nil, one()},
+			Rest:       &Identifier{Value: "rest"},
+			Body:       &BlockStatement{Statements: []Statement{}},
+		},
+		&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one()}},
+		&ArrayLiteral{Elements: []Expression{one(), one()}},
+	}
+
+	turnOneIntoTwo := func(node Node) Node {
+		if integer, ok := node.(*IntegerLiteral); ok && integer.Value == 1 {
+			integer.Value = 2
+		}
+		return node
+	}
+
+	for _, original := range tests {
+		before := original.String()
+
+		copied := Copy(original)
+		if !reflect.DeepEqual(copied, original) {
+			t.Errorf("copy differs from original. want=%#v, got=%#v", original, copied)
+		}
+
+		Modify(copied, turnOneIntoTwo)
+
+		if original.String() != before {
+			t.Errorf("modifying the copy changed the original. want=%q, got=%q", before, original.String())
+		}
+	}
+
+	hashLiteral := &HashLiteral{Pairs: map[Expression]Expression{one(): one()}}
+	copied := Copy(hashLiteral)
+	Modify(copied, turnOneIntoTwo)
+
+	for key, val := range hashLiteral.Pairs {
+		if key.(*IntegerLiteral).Value != 1 || val.(*IntegerLiteral).Value != 1 {
+			t.Errorf("modifying the copy changed the original hash literal")
+		}
+	}
+}
@@ -113,10 +113,64 @@ func TestModify(t *testing.T) {
 				},
 			},
 		},
+		{
+			&FunctionLiteral{
+				Parameters: []*Identifier{{Value: "a"}, {Value: "b"}},
+				Defaults:   []Expression{nil, one()},
+				Body:       &BlockStatement{Statements: []Statement{}},
+			},
+			&FunctionLiteral{
+				Parameters: []*Identifier{{Value: "a"}, {Value: "b"}},
+				Defaults:   []Expression{nil, two()},
+				Body:       &BlockStatement{Statements: []Statement{}},
+			},
+		},
 		{
 			&ArrayLiteral{Elements: []Expression{one(), one()}},
 			&ArrayLiteral{Elements: []Expression{two(), two()}},
 		},
+		{
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{one(), one()}},
+			&CallExpression{Function: &Identifier{Value: "f"}, Arguments: []Expression{two(), two()}},
+		},
+		{
+			&WhileStatement{
+				Condition: one(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&WhileStatement{
+				Condition: two(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
+		{
+			&ForStatement{
+				Variable: &Identifier{Value: "x"},
+				Iterable: one(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: one()},
+					},
+				},
+			},
+			&ForStatement{
+				Variable: &Identifier{Value: "x"},
+				Iterable: two(),
+				Body: &BlockStatement{
+					Statements: []Statement{
+						&ExpressionStatement{Expression: two()},
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/compiler"
+	"monkey/module"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BytecodeExt : default extension of compiled Monkey programs
+const BytecodeExt = ".mkc"
+
+// buildCommand : implements `monkey build <file> [-o output]`, compiling a source file to a bytecode file
+func buildCommand(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (defaults to the source file name with the "+BytecodeExt+" extension)")
+	path := pathFlag(fs)
+	optimize := optimizeFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: monkey build <file> [-o output] [--path dirs] [--optimize=false]\n")
+		fs.PrintDefaults()
+	}
+
+	files, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	program, ok := loadProgram(files[0])
+	if !ok {
+		return 1
+	}
+
+	bytecode, err := compileProgram(program, module.NewLoader(module.SplitPath(*path)), *optimize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	data, err := bytecode.MarshalBinary()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	out := *output
+	if out == "" {
+		out = strings.TrimSuffix(files[0], filepath.Ext(files[0])) + BytecodeExt
+	}
+
+	err = ioutil.WriteFile(out, data, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// execCommand : implements `monkey exec <file>`, running a bytecode file produced by `monkey build` on the vm
+func execCommand(args []string) int {
+	fs := flag.NewFlagSet("exec", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: monkey exec <file>\n")
+	}
+
+	files, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	bytecode, err := loadBytecode(files[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	err = runBytecode(bytecode)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func loadBytecode(path string) (*compiler.Bytecode, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	bytecode := &compiler.Bytecode{}
+	err = bytecode.UnmarshalBinary(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return bytecode, nil
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"monkey/token"
+	"sort"
 )
 
 type Instructions []byte
@@ -16,7 +18,7 @@ func (ins Instructions) String() string {
 		def, err := Lookup(ins[i])
 		if err != nil {
 			fmt.Fprintf(&out, "ERROR: %s\n", err)
-			continue
+			break
 		}
 
 		operands, read := ReadOperands(def, ins[i+1:])
@@ -47,6 +49,27 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
 
+// SourcePosition : source position the instruction starting at Offset was compiled from
+type SourcePosition struct {
+	Offset int
+	Pos    token.Position
+}
+
+// SourceMap : source positions of the instructions of a single instruction stream, sorted by offset
+type SourceMap []SourcePosition
+
+// Lookup : return the source position of the instruction containing the byte at offset
+func (sm SourceMap) Lookup(offset int) (token.Position, bool) {
+	i := sort.Search(len(sm), func(i int) bool {
+		return sm[i].Offset > offset
+	})
+	if i == 0 {
+		return token.Position{}, false
+	}
+
+	return sm[i-1].Pos, true
+}
+
 type Opcode byte
 
 const (
@@ -80,6 +103,44 @@ const (
 	OpClosure
 	OpGetFree
 	OpCurrentClosure
+	OpIter
+	OpIterNext
+	OpSetIndex
+	OpSetFree
+	OpCaptureLocal
+	OpCaptureFree
+	OpLessThan
+	OpLessEqual
+	OpGreaterEqual
+	OpMod
+	OpImport
+	OpSetupTry
+	OpPopTry
+	OpThrow
+	OpJumpIfProvided
+	OpUnpackArray
+	OpUnpackHash
+	OpTailCall
+	OpJumpTruthy
+	OpAddInt
+	OpSubInt
+	OpMulInt
+	OpDivInt
+	OpModInt
+	OpEqualInt
+	OpNotEqualInt
+	OpGreaterThanInt
+	OpLessThanInt
+	OpGreaterEqualInt
+	OpLessEqualInt
+	OpGetLocalAddConstant
+	OpGetLocalSubConstant
+	OpCompareJumpNotTruthy
+	OpCall0
+	OpCall1
+	OpCall2
+	OpStackDepth
+	OpSetStackDepth
 )
 
 type Definition struct {
@@ -104,7 +165,7 @@ var definitions = map[Opcode]*Definition{
 	OpBang:           {"OpBang", []int{}},
 	OpJumpNotTruthy:  {"OpJumpNotTruthy", []int{2}},
 	OpJump:           {"OpJump", []int{2}},
-	OpNull:           {"OpJump", []int{}},
+	OpNull:           {"OpNull", []int{}},
 	OpGetGlobal:      {"OpGetGlobal", []int{2}},
 	OpGetLocal:       {"OpGetLocal", []int{1}},
 	OpGetBuiltin:     {"OpGetBuiltin", []int{1}},
@@ -119,6 +180,109 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpIter:           {"OpIter", []int{}},
+	OpIterNext:       {"OpIterNext", []int{2}},
+	OpSetIndex:       {"OpSetIndex", []int{}},
+	OpSetFree:        {"OpSetFree", []int{1}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
+	OpLessThan:       {"OpLessThan", []int{}},
+	OpLessEqual:      {"OpLessEqual", []int{}},
+	OpGreaterEqual:   {"OpGreaterEqual", []int{}},
+	OpMod:            {"OpMod", []int{}},
+	OpImport:         {"OpImport", []int{2}},
+	OpSetupTry:       {"OpSetupTry", []int{2}},
+	OpPopTry:         {"OpPopTry", []int{}},
+	OpThrow:          {"OpThrow", []int{}},
+	OpJumpIfProvided: {"OpJumpIfProvided", []int{1, 2}},
+	OpUnpackArray:    {"OpUnpackArray", []int{2, 1}},
+	OpUnpackHash:     {"OpUnpackHash", []int{2}},
+	OpTailCall:       {"OpTailCall", []int{1}},
+	OpJumpTruthy:     {"OpJumpTruthy", []int{2}},
+
+	OpAddInt:          {"OpAddInt", []int{}},
+	OpSubInt:          {"OpSubInt", []int{}},
+	OpMulInt:          {"OpMulInt", []int{}},
+	OpDivInt:          {"OpDivInt", []int{}},
+	OpModInt:          {"OpModInt", []int{}},
+	OpEqualInt:        {"OpEqualInt", []int{}},
+	OpNotEqualInt:     {"OpNotEqualInt", []int{}},
+	OpGreaterThanInt:  {"OpGreaterThanInt", []int{}},
+	OpLessThanInt:     {"OpLessThanInt", []int{}},
+	OpGreaterEqualInt: {"OpGreaterEqualInt", []int{}},
+	OpLessEqualInt:    {"OpLessEqualInt", []int{}},
+
+	OpGetLocalAddConstant:  {"OpGetLocalAddConstant", []int{1, 2}},
+	OpGetLocalSubConstant:  {"OpGetLocalSubConstant", []int{1, 2}},
+	OpCompareJumpNotTruthy: {"OpCompareJumpNotTruthy", []int{1, 2}},
+	OpCall0:                {"OpCall0", []int{}},
+	OpCall1:                {"OpCall1", []int{}},
+	OpCall2:                {"OpCall2", []int{}},
+
+	OpStackDepth:    {"OpStackDepth", []int{}},
+	OpSetStackDepth: {"OpSetStackDepth", []int{}},
+}
+
+// jumpOperands : for opcodes transferring control, index of the operand holding the absolute jump target
+var jumpOperands = map[Opcode]int{
+	OpJumpNotTruthy:  0,
+	OpJump:           0,
+	OpIterNext:       0,
+	OpSetupTry:       0,
+	OpJumpIfProvided: 1,
+	OpJumpTruthy:     0,
+
+	OpCompareJumpNotTruthy: 1,
+}
+
+// integerOpcodes : integer specializations of the arithmetic and comparison opcodes. The compiler never emits them,
+// the VM rewrites an instruction in place to its specialization after seeing integer operands, and back when it sees
+// others. Both have no operands, so the rewrite keeps the offsets
+var integerOpcodes = map[Opcode]Opcode{
+	OpAdd:          OpAddInt,
+	OpSub:          OpSubInt,
+	OpMul:          OpMulInt,
+	OpDiv:          OpDivInt,
+	OpMod:          OpModInt,
+	OpEqual:        OpEqualInt,
+	OpNotEqual:     OpNotEqualInt,
+	OpGreaterThan:  OpGreaterThanInt,
+	OpLessThan:     OpLessThanInt,
+	OpGreaterEqual: OpGreaterEqualInt,
+	OpLessEqual:    OpLessEqualInt,
+}
+
+// genericOpcodes : the generic opcode of each integer specialization
+var genericOpcodes = map[Opcode]Opcode{
+	OpAddInt:          OpAdd,
+	OpSubInt:          OpSub,
+	OpMulInt:          OpMul,
+	OpDivInt:          OpDiv,
+	OpModInt:          OpMod,
+	OpEqualInt:        OpEqual,
+	OpNotEqualInt:     OpNotEqual,
+	OpGreaterThanInt:  OpGreaterThan,
+	OpLessThanInt:     OpLessThan,
+	OpGreaterEqualInt: OpGreaterEqual,
+	OpLessEqualInt:    OpLessEqual,
+}
+
+// IntegerOpcode : return the integer specialization of op, if it has one
+func IntegerOpcode(op Opcode) (Opcode, bool) {
+	specialized, ok := integerOpcodes[op]
+	return specialized, ok
+}
+
+// GenericOpcode : return the generic opcode of the integer specialization op, if op is one
+func GenericOpcode(op Opcode) (Opcode, bool) {
+	generic, ok := genericOpcodes[op]
+	return generic, ok
+}
+
+// JumpOperand : return the index of the operand holding the jump target of op, if op is a jump
+func JumpOperand(op Opcode) (int, bool) {
+	i, ok := jumpOperands[op]
+	return i, ok
 }
 
 func Lookup(op byte) (*Definition, error) {
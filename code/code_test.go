@@ -18,6 +18,10 @@ func TestMake(t *testing.T) {
 		{OpDiv, []int{}, []byte{byte(OpDiv)}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpJumpIfProvided, []int{2, 65534}, []byte{byte(OpJumpIfProvided), 2, 255, 254}},
+		{OpTailCall, []int{255}, []byte{byte(OpTailCall), 255}},
+		{OpJumpTruthy, []int{65534}, []byte{byte(OpJumpTruthy), 255, 254}},
+		{OpAddInt, []int{}, []byte{byte(OpAddInt)}},
 	}
 
 	for _, tt := range tests {
@@ -78,6 +82,7 @@ func TestReadOperands(t *testing.T) {
 		{OpConstant, []int{65535}, 2},
 		{OpGetLocal, []int{255}, 1},
 		{OpClosure, []int{65535, 255}, 3},
+		{OpJumpIfProvided, []int{255, 65535}, 3},
 	}
 
 	for _, tt := range tests {
@@ -100,3 +105,19 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestIntegerOpcodes(t *testing.T) {
+	for generic, specialized := range integerOpcodes {
+		if op, ok := GenericOpcode(specialized); !ok || op != generic {
+			t.Errorf("wrong generic opcode of %s. want=%s, got=%d", definitions[specialized].Name,
+				definitions[generic].Name, op)
+		}
+		if len(definitions[generic].OperandWidths) != len(definitions[specialized].OperandWidths) {
+			t.Errorf("%s and %s have different operands", definitions[generic].Name, definitions[specialized].Name)
+		}
+	}
+
+	if _, ok := IntegerOpcode(OpConstant); ok {
+		t.Errorf("OpConstant has an integer specialization")
+	}
+}
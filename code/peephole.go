@@ -0,0 +1,279 @@
+package code
+
+import "monkey/token"
+
+// peepholeInstruction : a decoded instruction being optimized. Jumps refer to the index of their target, which is the
+// number of instructions for the end of the stream
+type peepholeInstruction struct {
+	op       Opcode
+	operands []int
+	target   int
+	pos      token.Position
+	hasPos   bool
+	dead     bool
+}
+
+// Optimize : run a peephole pass over ins and return the optimized instructions with their source map. Jumps to jumps
+// are threaded, jumps to returns become returns, OpBang before a conditional jump inverts the jump, unreachable
+// instructions and jumps to the next instruction are removed, and so are the nulls pushed only to be popped, unless
+// keepPops is set because the value last popped is the result of the instructions, as for the main program. The
+// instructions keep the source positions they had
+func Optimize(ins Instructions, sourceMap SourceMap, keepPops bool) (Instructions, SourceMap) {
+	list, ok := decodeInstructions(ins, sourceMap)
+	if !ok {
+		return ins, sourceMap
+	}
+
+	for changed := true; changed; {
+		changed = false
+		resolveTargets(list)
+
+		for _, f := range []func([]*peepholeInstruction, bool) bool{
+			threadJumps,
+			mergeBangs,
+			removeNullPops,
+			removeUnreachable,
+			removeJumpsToNext,
+		} {
+			if f(list, keepPops) {
+				changed = true
+				resolveTargets(list)
+			}
+		}
+	}
+
+	return encodeInstructions(list)
+}
+
+// decodeInstructions : split ins into instructions, reporting false when it holds unknown opcodes or jumps into the
+// middle of an instruction
+func decodeInstructions(ins Instructions, sourceMap SourceMap) ([]*peepholeInstruction, bool) {
+	list := []*peepholeInstruction{}
+	indexes := map[int]int{}
+
+	for i := 0; i < len(ins); {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			return nil, false
+		}
+		operands, read := ReadOperands(def, ins[i+1:])
+		pos, hasPos := sourceMap.Lookup(i)
+
+		indexes[i] = len(list)
+		list = append(list, &peepholeInstruction{op: Opcode(ins[i]), operands: operands, pos: pos, hasPos: hasPos})
+		i += 1 + read
+	}
+	indexes[len(ins)] = len(list)
+
+	for _, in := range list {
+		j, ok := JumpOperand(in.op)
+		if !ok {
+			continue
+		}
+		target, ok := indexes[in.operands[j]]
+		if !ok {
+			return nil, false
+		}
+		in.target = target
+	}
+
+	return list, true
+}
+
+// encodeInstructions : the bytes and the source map of the live instructions of list
+func encodeInstructions(list []*peepholeInstruction) (Instructions, SourceMap) {
+	offsets := make([]int, len(list)+1)
+	offset := 0
+	for i, in := range list {
+		offsets[i] = offset
+		if !in.dead {
+			offset += len(Make(in.op, in.operands...))
+		}
+	}
+	offsets[len(list)] = offset
+
+	ins := Instructions{}
+	sourceMap := SourceMap{}
+	for i, in := range list {
+		if in.dead {
+			continue
+		}
+		if j, ok := JumpOperand(in.op); ok {
+			in.operands[j] = offsets[in.target]
+		}
+		if in.hasPos {
+			sourceMap = append(sourceMap, SourcePosition{Offset: offsets[i], Pos: in.pos})
+		}
+		ins = append(ins, Make(in.op, in.operands...)...)
+	}
+
+	return ins, sourceMap
+}
+
+// resolveTargets : move the targets of the jumps off removed instructions, to the next live one. Instructions are
+// only removed when jumping to the next one has the same effect
+func resolveTargets(list []*peepholeInstruction) {
+	for _, in := range list {
+		if _, ok := JumpOperand(in.op); ok && !in.dead {
+			in.target = nextLive(list, in.target)
+		}
+	}
+}
+
+func nextLive(list []*peepholeInstruction, i int) int {
+	for i < len(list) && list[i].dead {
+		i++
+	}
+	return i
+}
+
+// isTarget : report whether a live jump goes to the instruction at index i
+func isTarget(list []*peepholeInstruction, i int) bool {
+	for _, in := range list {
+		if _, ok := JumpOperand(in.op); ok && !in.dead && in.target == i {
+			return true
+		}
+	}
+	return false
+}
+
+// threadJumps : make jumps to an OpJump go to its target, and turn jumps to a return into the return
+func threadJumps(list []*peepholeInstruction, keepPops bool) bool {
+	changed := false
+
+	for _, in := range list {
+		if _, ok := JumpOperand(in.op); !ok || in.dead {
+			continue
+		}
+
+		// a chain of jumps is at most as long as the instructions, a longer one is a cycle
+		for steps := 0; in.target < len(list) && list[in.target].op == OpJump && steps < len(list); steps++ {
+			if list[in.target].target == in.target {
+				break
+			}
+			in.target = list[in.target].target
+			changed = true
+		}
+
+		if in.op == OpJump && in.target < len(list) {
+			switch ret := list[in.target].op; ret {
+			case OpReturnValue, OpReturn:
+				in.op = ret
+				in.operands = []int{}
+				changed = true
+			}
+		}
+	}
+
+	return changed
+}
+
+// mergeBangs : turn OpBang followed by a conditional jump into the opposite jump, unless the jump is reached without
+// going through the OpBang
+func mergeBangs(list []*peepholeInstruction, keepPops bool) bool {
+	changed := false
+
+	for i, in := range list {
+		if in.dead || in.op != OpBang {
+			continue
+		}
+		next := nextLive(list, i+1)
+		if next == len(list) || isTarget(list, next) {
+			continue
+		}
+
+		switch list[next].op {
+		case OpJumpNotTruthy:
+			list[next].op = OpJumpTruthy
+		case OpJumpTruthy:
+			list[next].op = OpJumpNotTruthy
+		default:
+			continue
+		}
+		in.dead = true
+		changed = true
+	}
+
+	return changed
+}
+
+// removeNullPops : remove the nulls pushed only to be popped, by OpNull followed by OpPop or by a jump to OpPop, the
+// jump then going past the OpPop
+func removeNullPops(list []*peepholeInstruction, keepPops bool) bool {
+	if keepPops {
+		return false
+	}
+	changed := false
+
+	for i, in := range list {
+		if in.dead || in.op != OpNull {
+			continue
+		}
+		next := nextLive(list, i+1)
+		if next == len(list) {
+			continue
+		}
+
+		switch after := list[next]; {
+		case after.op == OpPop && !isTarget(list, next):
+			in.dead = true
+			after.dead = true
+			changed = true
+		case after.op == OpJump && !isTarget(list, next) && after.target < len(list) && list[after.target].op == OpPop:
+			in.dead = true
+			after.target = nextLive(list, after.target+1)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeUnreachable : remove the instructions that no path from the first one reaches
+func removeUnreachable(list []*peepholeInstruction, keepPops bool) bool {
+	reached := make([]bool, len(list))
+	pending := []int{0}
+
+	for len(pending) > 0 {
+		i := nextLive(list, pending[len(pending)-1])
+		pending = pending[:len(pending)-1]
+		if i == len(list) || reached[i] {
+			continue
+		}
+		reached[i] = true
+
+		in := list[i]
+		if _, ok := JumpOperand(in.op); ok {
+			pending = append(pending, in.target)
+		}
+		switch in.op {
+		case OpJump, OpReturnValue, OpReturn, OpThrow:
+		default:
+			pending = append(pending, i+1)
+		}
+	}
+
+	changed := false
+	for i, in := range list {
+		if !in.dead && !reached[i] {
+			in.dead = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// removeJumpsToNext : remove the unconditional jumps to the instruction right after them
+func removeJumpsToNext(list []*peepholeInstruction, keepPops bool) bool {
+	changed := false
+
+	for i, in := range list {
+		if !in.dead && in.op == OpJump && in.target == nextLive(list, i+1) {
+			in.dead = true
+			changed = true
+		}
+	}
+
+	return changed
+}
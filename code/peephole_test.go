@@ -0,0 +1,296 @@
+package code
+
+import (
+	"monkey/token"
+	"reflect"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []Instructions
+		keepPops bool
+		expected []Instructions
+	}{
+		{
+			"jump to jump",
+			[]Instructions{
+				Make(OpGetGlobal, 0),
+				Make(OpJumpNotTruthy, 10),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpJump, 0),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetGlobal, 0),
+				Make(OpJumpNotTruthy, 0),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpJump, 0),
+			},
+		},
+		{
+			"jump to return",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 11),
+				Make(OpConstant, 0),
+				Make(OpJump, 14),
+				Make(OpConstant, 1),
+				Make(OpReturnValue),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 9),
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpConstant, 1),
+				Make(OpReturnValue),
+			},
+		},
+		{
+			"bang before a conditional jump",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpBang),
+				Make(OpJumpNotTruthy, 10),
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpTruthy, 9),
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+		},
+		{
+			"double bang before a conditional jump",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpBang),
+				Make(OpBang),
+				Make(OpJumpNotTruthy, 11),
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 9),
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+		},
+		{
+			"bang before a conditional jump reached from elsewhere",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 8),
+				Make(OpGetLocal, 1),
+				Make(OpBang),
+				Make(OpJumpNotTruthy, 12),
+				Make(OpNull),
+				Make(OpReturnValue),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 8),
+				Make(OpGetLocal, 1),
+				Make(OpBang),
+				Make(OpJumpNotTruthy, 12),
+				Make(OpNull),
+				Make(OpReturnValue),
+			},
+		},
+		{
+			"null popped",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 14),
+				Make(OpConstant, 0),
+				Make(OpSetLocal, 1),
+				Make(OpNull),
+				Make(OpJump, 15),
+				Make(OpNull),
+				Make(OpPop),
+				Make(OpReturn),
+			},
+			false,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 10),
+				Make(OpConstant, 0),
+				Make(OpSetLocal, 1),
+				Make(OpReturn),
+			},
+		},
+		{
+			"null popped as result",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 14),
+				Make(OpConstant, 0),
+				Make(OpSetLocal, 1),
+				Make(OpNull),
+				Make(OpJump, 15),
+				Make(OpNull),
+				Make(OpPop),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 14),
+				Make(OpConstant, 0),
+				Make(OpSetLocal, 1),
+				Make(OpNull),
+				Make(OpJump, 15),
+				Make(OpNull),
+				Make(OpPop),
+				Make(OpReturn),
+			},
+		},
+		{
+			"unreachable instructions",
+			[]Instructions{
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+				Make(OpConstant, 1),
+				Make(OpPop),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpConstant, 0),
+				Make(OpReturnValue),
+			},
+		},
+		{
+			"jump to the next instruction",
+			[]Instructions{
+				Make(OpJump, 3),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpReturn),
+			},
+		},
+		{
+			"catch address",
+			[]Instructions{
+				Make(OpSetupTry, 7),
+				Make(OpPopTry),
+				Make(OpJump, 10),
+				Make(OpJump, 10),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpSetupTry, 5),
+				Make(OpPopTry),
+				Make(OpReturn),
+				Make(OpReturn),
+			},
+		},
+		{
+			"loop",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 16),
+				Make(OpGetLocal, 1),
+				Make(OpJumpNotTruthy, 13),
+				Make(OpJump, 16),
+				Make(OpJump, 0),
+				Make(OpReturn),
+			},
+			true,
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpNotTruthy, 11),
+				Make(OpGetLocal, 1),
+				Make(OpJumpNotTruthy, 0),
+				Make(OpReturn),
+				Make(OpReturn),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		actual, _ := Optimize(concat(tt.input), nil, tt.keepPops)
+
+		expected := concat(tt.expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: wrong instructions.\nwant=\n%s\ngot=\n%s", tt.name, expected, actual)
+		}
+	}
+}
+
+func TestOptimizeSourceMap(t *testing.T) {
+	pos := func(line int) token.Position {
+		return token.Position{Line: line, Column: 1}
+	}
+
+	input := concat([]Instructions{
+		Make(OpGetLocal, 0),
+		Make(OpBang),
+		Make(OpJumpNotTruthy, 13),
+		Make(OpConstant, 0),
+		Make(OpReturnValue),
+		Make(OpConstant, 1),
+		Make(OpConstant, 2),
+		Make(OpReturnValue),
+	})
+	sourceMap := SourceMap{
+		{Offset: 0, Pos: pos(1)},
+		{Offset: 2, Pos: pos(2)},
+		{Offset: 3, Pos: pos(3)},
+		{Offset: 6, Pos: pos(4)},
+		{Offset: 10, Pos: pos(5)},
+		{Offset: 13, Pos: pos(6)},
+	}
+
+	actual, actualMap := Optimize(input, sourceMap, true)
+
+	expected := concat([]Instructions{
+		Make(OpGetLocal, 0),
+		Make(OpJumpTruthy, 9),
+		Make(OpConstant, 0),
+		Make(OpReturnValue),
+		Make(OpConstant, 2),
+		Make(OpReturnValue),
+	})
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong instructions.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+
+	expectedMap := SourceMap{
+		{Offset: 0, Pos: pos(1)},
+		{Offset: 2, Pos: pos(3)},
+		{Offset: 5, Pos: pos(4)},
+		{Offset: 8, Pos: pos(4)},
+		{Offset: 9, Pos: pos(6)},
+		{Offset: 12, Pos: pos(6)},
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("wrong source map.\nwant=%v\ngot=%v", expectedMap, actualMap)
+	}
+}
+
+func concat(list []Instructions) Instructions {
+	out := Instructions{}
+	for _, ins := range list {
+		out = append(out, ins...)
+	}
+	return out
+}
@@ -0,0 +1,81 @@
+package code
+
+// comparisons : the opcodes OpCompareJumpNotTruthy fuses with the conditional jump following them
+var comparisons = map[Opcode]bool{
+	OpEqual:        true,
+	OpNotEqual:     true,
+	OpGreaterThan:  true,
+	OpLessThan:     true,
+	OpGreaterEqual: true,
+	OpLessEqual:    true,
+}
+
+// callOpcodes : the superinstructions calling with a given number of arguments
+var callOpcodes = map[int]Opcode{
+	0: OpCall0,
+	1: OpCall1,
+	2: OpCall2,
+}
+
+// Fuse : replace common sequences of instructions by superinstructions running the whole sequence in one dispatch.
+// OpGetLocal, OpConstant then OpAdd or OpSub become OpGetLocalAddConstant or OpGetLocalSubConstant, a comparison
+// followed by OpJumpNotTruthy becomes OpCompareJumpNotTruthy, and OpCall with up to 2 arguments becomes OpCall0,
+// OpCall1 or OpCall2. Only the first instruction of a sequence may be a jump target. A superinstruction has the source
+// position of the instruction of its sequence that can fail
+func Fuse(ins Instructions, sourceMap SourceMap) (Instructions, SourceMap) {
+	list, ok := decodeInstructions(ins, sourceMap)
+	if !ok {
+		return ins, sourceMap
+	}
+
+	targets := map[int]bool{}
+	for _, in := range list {
+		if _, ok := JumpOperand(in.op); ok {
+			targets[in.target] = true
+		}
+	}
+
+	// followedBy reports whether the instructions after the one at i are ops, none of them being a jump target
+	followedBy := func(i int, ops ...Opcode) bool {
+		if i+len(ops) >= len(list) {
+			return false
+		}
+		for j, op := range ops {
+			if targets[i+1+j] || list[i+1+j].op != op {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < len(list); i++ {
+		in := list[i]
+
+		switch {
+		case in.op == OpGetLocal && (followedBy(i, OpConstant, OpAdd) || followedBy(i, OpConstant, OpSub)):
+			in.op = OpGetLocalAddConstant
+			if list[i+2].op == OpSub {
+				in.op = OpGetLocalSubConstant
+			}
+			in.operands = []int{in.operands[0], list[i+1].operands[0]}
+			in.pos, in.hasPos = list[i+2].pos, list[i+2].hasPos
+			list[i+1].dead = true
+			list[i+2].dead = true
+			i += 2
+		case comparisons[in.op] && followedBy(i, OpJumpNotTruthy):
+			jump := list[i+1]
+			in.operands = []int{int(in.op), 0}
+			in.op = OpCompareJumpNotTruthy
+			in.target = jump.target
+			jump.dead = true
+			i++
+		case in.op == OpCall:
+			if op, ok := callOpcodes[in.operands[0]]; ok {
+				in.op = op
+				in.operands = []int{}
+			}
+		}
+	}
+
+	return encodeInstructions(list)
+}
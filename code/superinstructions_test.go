@@ -0,0 +1,159 @@
+package code
+
+import (
+	"monkey/token"
+	"reflect"
+	"testing"
+)
+
+func TestFuse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []Instructions
+		expected []Instructions
+	}{
+		{
+			"local plus constant",
+			[]Instructions{
+				Make(OpGetLocal, 1),
+				Make(OpConstant, 2),
+				Make(OpAdd),
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 3),
+				Make(OpSub),
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 3),
+				Make(OpMul),
+			},
+			[]Instructions{
+				Make(OpGetLocalAddConstant, 1, 2),
+				Make(OpGetLocalSubConstant, 0, 3),
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 3),
+				Make(OpMul),
+			},
+		},
+		{
+			"constant reached from elsewhere",
+			[]Instructions{
+				Make(OpJumpNotTruthy, 6),
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 0),
+				Make(OpAdd),
+			},
+			[]Instructions{
+				Make(OpJumpNotTruthy, 6),
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 0),
+				Make(OpAdd),
+			},
+		},
+		{
+			"compare and jump",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 0),
+				Make(OpLessThan),
+				Make(OpJumpNotTruthy, 11),
+				Make(OpNull),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpConstant, 0),
+				Make(OpCompareJumpNotTruthy, int(OpLessThan), 11),
+				Make(OpNull),
+				Make(OpReturnValue),
+				Make(OpReturn),
+			},
+		},
+		{
+			"conditional jump reached from elsewhere",
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpTruthy, 7),
+				Make(OpEqual),
+				Make(OpJumpNotTruthy, 0),
+				Make(OpReturn),
+			},
+			[]Instructions{
+				Make(OpGetLocal, 0),
+				Make(OpJumpTruthy, 7),
+				Make(OpEqual),
+				Make(OpJumpNotTruthy, 0),
+				Make(OpReturn),
+			},
+		},
+		{
+			"calls",
+			[]Instructions{
+				Make(OpCall, 0),
+				Make(OpCall, 1),
+				Make(OpCall, 2),
+				Make(OpCall, 3),
+				Make(OpTailCall, 1),
+			},
+			[]Instructions{
+				Make(OpCall0),
+				Make(OpCall1),
+				Make(OpCall2),
+				Make(OpCall, 3),
+				Make(OpTailCall, 1),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		actual, _ := Fuse(concat(tt.input), nil)
+
+		expected := concat(tt.expected)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: wrong instructions.\nwant=\n%s\ngot=\n%s", tt.name, expected, actual)
+		}
+	}
+}
+
+func TestFuseSourceMap(t *testing.T) {
+	pos := func(line int) token.Position {
+		return token.Position{Line: line, Column: 1}
+	}
+
+	input := concat([]Instructions{
+		Make(OpGetLocal, 0),
+		Make(OpConstant, 0),
+		Make(OpSub),
+		Make(OpConstant, 1),
+		Make(OpGreaterThan),
+		Make(OpJumpNotTruthy, 13),
+		Make(OpReturn),
+	})
+	sourceMap := SourceMap{
+		{Offset: 0, Pos: pos(1)},
+		{Offset: 5, Pos: pos(2)},
+		{Offset: 9, Pos: pos(3)},
+		{Offset: 10, Pos: pos(4)},
+	}
+
+	actual, actualMap := Fuse(input, sourceMap)
+
+	expected := concat([]Instructions{
+		Make(OpGetLocalSubConstant, 0, 0),
+		Make(OpConstant, 1),
+		Make(OpCompareJumpNotTruthy, int(OpGreaterThan), 11),
+		Make(OpReturn),
+	})
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("wrong instructions.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+
+	expectedMap := SourceMap{
+		{Offset: 0, Pos: pos(2)},
+		{Offset: 4, Pos: pos(2)},
+		{Offset: 7, Pos: pos(3)},
+		{Offset: 11, Pos: pos(4)},
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("wrong source map.\nwant=%v\ngot=%v", expectedMap, actualMap)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/frontend"
+	"monkey/module"
 	"monkey/object"
+	"monkey/optimizer"
+	"monkey/token"
 	"sort"
 )
 
@@ -15,8 +19,27 @@ type EmittedInstruction struct {
 
 type CompilationScope struct {
 	instructions    code.Instructions
+	sourceMap       code.SourceMap
 	lastInstruction EmittedInstruction
 	prevInstruction EmittedInstruction
+
+	loops []*LoopScope // loops enclosing the code being compiled, innermost last
+	tries []*TryScope  // try blocks whose handler is active around the code being compiled, innermost last
+}
+
+// LoopScope : jump targets of a loop being compiled. Jumps of break statements are back-patched once the end of the
+// loop is known
+type LoopScope struct {
+	continueTarget int
+	breakJumps     []int
+	tries          int     // number of try blocks enclosing the loop
+	depth          *Symbol // slot holding the stack depth at the start of the loop, nil without break or continue
+}
+
+// TryScope : a try block, or a catch block followed by a finally block, being compiled. Code jumping out of it with
+// a return, break or continue pops its handler and runs finally first
+type TryScope struct {
+	finally *ast.BlockStatement
 }
 
 type Compiler struct {
@@ -25,6 +48,12 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	position token.Position // source position of the node being compiled
+
+	loader *module.Loader // finds imported modules, shared with the compilers of the modules
+
+	optimize bool // run the optimizer on the compiled programs, and on the modules they import
 }
 
 func New() *Compiler {
@@ -44,6 +73,8 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		loader:      module.NewLoader(module.DefaultSearchPath()),
+		optimize:    true,
 	}
 }
 
@@ -54,6 +85,18 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	return c
 }
 
+// SetLoader : set the loader finding the modules imported by the compiled programs, by default looking up the
+// directories of the MONKEYPATH environment variable
+func (c *Compiler) SetLoader(loader *module.Loader) {
+	c.loader = loader
+}
+
+// SetOptimize : enable or disable the optimization of the compiled programs, enabled by default. The optimizer changes
+// the programs in place before they are compiled
+func (c *Compiler) SetOptimize(enabled bool) {
+	c.optimize = enabled
+}
+
 func (c *Compiler) currentInstructions() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
@@ -69,25 +112,41 @@ func (c *Compiler) enterScope() {
 	c.symbolTable = NewEnclosedSymbolTable(c.symbolTable)
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
+func (c *Compiler) leaveScope() (code.Instructions, code.SourceMap) {
 	instructions := c.currentInstructions()
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
 
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
 	c.symbolTable = c.symbolTable.Outer
 
-	return instructions
+	return instructions, sourceMap
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	prevPosition := c.position
+	if pos := node.Pos(); pos.IsValid() {
+		c.position = pos
+	}
+	defer func() { c.position = prevPosition }()
+
 	switch node := node.(type) {
 	case *ast.Program:
+		if c.optimize {
+			node = optimizer.Optimize(node)
+		}
+
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
 				return err
 			}
 		}
+
+		// the value last popped is the result of the program
+		if c.optimize {
+			c.optimizeInstructions(true)
+		}
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
 			err := c.Compile(s)
@@ -96,24 +155,114 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 	case *ast.LetStatement:
+		if node.Pattern != nil {
+			err := c.Compile(node.Value)
+			if err != nil {
+				return err
+			}
+
+			c.compilePattern(node.Pattern)
+			return nil
+		}
+
 		symbol := c.symbolTable.Define(node.Name.Value)
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
+		c.storeSymbol(symbol)
+	case *ast.WhileStatement:
+		depth := c.saveStackDepth(node.Body)
+		start := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		err = c.compileLoopBody(node.Body, start, depth)
+		if err != nil {
+			return err
+		}
+
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	case *ast.ForStatement:
+		err := c.Compile(node.Iterable)
+		if err != nil {
+			return err
+		}
+
+		// errors about values that are not iterable point to the iterable expression
+		c.position = node.Iterable.Pos()
+		c.emit(code.OpIter)
+		c.position = node.Pos()
+
+		iterator := c.symbolTable.allocate()
+		c.storeSymbol(iterator)
+
+		variable := c.symbolTable.Define(node.Variable.Value)
+
+		depth := c.saveStackDepth(node.Body)
+		start := len(c.currentInstructions())
+		c.loadSymbol(iterator)
+		iterNextPos := c.emit(code.OpIterNext, 9999)
+		c.storeSymbol(variable)
+
+		err = c.compileLoopBody(node.Body, start, depth)
+		if err != nil {
+			return err
+		}
+
+		c.changeOperand(iterNextPos, len(c.currentInstructions()))
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: break outside loop", node.Pos())
+		}
+
+		err := c.unwindTries(loop.tries)
+		if err != nil {
+			return err
+		}
+
+		c.restoreStackDepth(loop)
+		pos := c.emit(code.OpJump, 9999)
+		loop.breakJumps = append(loop.breakJumps, pos)
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: continue outside loop", node.Pos())
 		}
+
+		err := c.unwindTries(loop.tries)
+		if err != nil {
+			return err
+		}
+
+		c.restoreStackDepth(loop)
+		c.emit(code.OpJump, loop.continueTarget)
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
 
+		err = c.unwindTries(0)
+		if err != nil {
+			return err
+		}
+
 		c.emit(code.OpReturnValue)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(code.OpThrow)
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
 		if err != nil {
@@ -132,20 +281,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 	case *ast.InfixExpression:
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 
 		err := c.Compile(node.Left)
@@ -167,14 +307,22 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
+		case ">=":
+			c.emit(code.OpGreaterEqual)
+		case "<=":
+			c.emit(code.OpLessEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 	case *ast.IfExpression:
 		err := c.Compile(node.Condition)
@@ -184,15 +332,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, -1) // junk -1 as placeholder
 
-		err = c.Compile(node.Consequence)
+		err = c.compileBlockValue(node.Consequence)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
-
 		jumpPos := c.emit(code.OpJump, -1) // junk -1 as placeholder
 
 		afterConsequencePos := len(c.currentInstructions())
@@ -201,19 +345,16 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
-			err = c.Compile(node.Alternative)
+			err = c.compileBlockValue(node.Alternative)
 			if err != nil {
 				return err
 			}
-
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
-
 		}
 
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
 	case *ast.IndexExpression:
 		err := c.Compile(node.Left)
 		if err != nil {
@@ -227,6 +368,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 	case *ast.CallExpression:
+		if node.Function.TokenLiteral() == "quote" {
+			return c.compileQuote(node)
+		}
+
 		err := c.Compile(node.Function)
 		if err != nil {
 			return err
@@ -243,6 +388,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
@@ -255,7 +403,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return fmt.Errorf("%s: undefined variable %s", node.Pos(), node.Value)
 		}
 
 		c.loadSymbol(symbol)
@@ -291,43 +439,472 @@ func (c *Compiler) Compile(node ast.Node) error {
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
-		if node.Name != "" {
+		// a function assigning to its own name reads the variable it is bound to, as the evaluator does, since that
+		// variable may no longer hold the function
+		if node.Name != "" && !assignsTo(node, node.Name) {
 			c.symbolTable.DefineFunctionName(node.Name)
 		}
 
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
+		params := make([]Symbol, len(node.Parameters))
+		for i, p := range node.Parameters {
+			params[i] = c.symbolTable.Define(p.Value)
+		}
+		if node.Rest != nil {
+			c.symbolTable.Define(node.Rest.Value)
+		}
+
+		numDefaults, err := c.compileDefaults(node.Defaults, params)
+		if err != nil {
+			return err
 		}
 
-		err := c.Compile(node.Body)
+		err = c.Compile(node.Body)
 		if err != nil {
 			return err
 		}
 
-		if c.lastInstructionIs(code.OpPop) {
+		if endsWithExpression(node.Body) {
 			c.replaceLastPopWithReturn()
 		}
 		if !c.lastInstructionIs(code.OpReturnValue) {
 			c.emit(code.OpReturn)
 		}
+		c.markTailCalls()
+		if c.optimize {
+			c.optimizeInstructions(false)
+		}
 
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		instructions, sourceMap := c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+			c.captureSymbol(s)
 		}
 
 		compiledFn := &object.CompiledFunction{
 			Instructions:  instructions,
+			SourceMap:     sourceMap,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			NumDefaults:   numDefaults,
+			Variadic:      node.Rest != nil,
+			Name:          node.Name,
 		}
 		fnIndex := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
+	case *ast.AssignExpression:
+		return c.compileAssignment(node)
+	case *ast.ImportExpression:
+		mod, err := c.loader.Load(node.Path, node.Pos().Filename, c.compileModule)
+		if err != nil {
+			return fmt.Errorf("%s: %s", node.Pos(), err)
+		}
+
+		c.emit(code.OpImport, c.addConstant(mod))
+	case *ast.MacroLiteral:
+		return fmt.Errorf("%s: macros can only be defined by top-level let statements", node.Pos())
+	}
+
+	return nil
+}
+
+// compileDefaults : compile the prologue of a function storing the default values of the parameters whose argument is
+// missing. Each default is evaluated at call time, after the parameters before it have been bound
+func (c *Compiler) compileDefaults(defaults []ast.Expression, params []Symbol) (int, error) {
+	numDefaults := 0
+
+	for i, value := range defaults {
+		if value == nil {
+			continue
+		}
+		numDefaults++
+
+		jumpPos := c.emit(code.OpJumpIfProvided, params[i].Index, 9999)
+
+		err := c.Compile(value)
+		if err != nil {
+			return 0, err
+		}
+		c.storeSymbol(params[i])
+
+		c.replaceInstruction(jumpPos, code.Make(code.OpJumpIfProvided, params[i].Index, len(c.currentInstructions())))
+	}
+
+	return numDefaults, nil
+}
+
+// compilePattern : compile the destructuring of the value on top of the stack, binding the identifiers of pattern. The
+// unpacking instructions push the matched parts in reverse order, so that they are popped in the order of the pattern
+func (c *Compiler) compilePattern(pattern ast.Pattern) {
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		symbol := c.symbolTable.Define(pattern.Value)
+		c.storeSymbol(symbol)
+	case *ast.ArrayPattern:
+		rest := 0
+		if pattern.Rest != nil {
+			rest = 1
+		}
+		c.position = pattern.Pos()
+		c.emit(code.OpUnpackArray, len(pattern.Elements), rest)
+
+		for _, el := range pattern.Elements {
+			c.compilePattern(el)
+		}
+		if pattern.Rest != nil {
+			c.compilePattern(pattern.Rest)
+		}
+	case *ast.HashPattern:
+		for _, key := range pattern.Keys {
+			c.emit(code.OpConstant, c.addConstant(&object.String{Value: key.Value}))
+		}
+		c.position = pattern.Pos()
+		c.emit(code.OpUnpackHash, len(pattern.Keys))
+
+		for _, value := range pattern.Values {
+			c.compilePattern(value)
+		}
+	}
+}
+
+// compileAssignment : compile an assignment, leaving the assigned value on the stack
+func (c *Compiler) compileAssignment(node *ast.AssignExpression) error {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.ResolveBinding(target.Value)
+		if !ok {
+			return fmt.Errorf("%s: undefined variable %s", target.Pos(), target.Value)
+		}
+		if symbol.Scope == BuiltinScope {
+			return fmt.Errorf("%s: cannot assign to builtin %s", target.Pos(), target.Value)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.storeSymbol(symbol)
+		c.loadSymbol(symbol)
+	case *ast.IndexExpression:
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		// errors about the collection or the index point to the index expression
+		c.position = target.Pos()
+		c.emit(code.OpSetIndex)
+		c.position = node.Pos()
+	default:
+		return fmt.Errorf("%s: invalid assignment target %s", node.Pos(), node.Target.String())
+	}
+
+	return nil
+}
+
+// compileLogicalExpression : compile && and || so that the right operand is only evaluated when it decides the result.
+// The result is always a boolean, the right operand being converted by a double negation
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	var jumpPos int
+	if node.Operator == "||" {
+		c.emit(code.OpTrue)
+		jumpPos = c.emit(code.OpJump, 9999)
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpBang)
+	c.emit(code.OpBang)
+
+	if node.Operator == "&&" {
+		jumpPos = c.emit(code.OpJump, 9999)
+		c.changeOperand(jumpNotTruthyPos, len(c.currentInstructions()))
+		c.emit(code.OpFalse)
 	}
 
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+
+	return nil
+}
+
+// compileTryExpression : compile a try expression, leaving the value of its body or catch block on the stack. The
+// handler set up before the body resumes at the catch block, with the error on the stack. With a finally block, the
+// catch block gets a handler of its own, and errors thrown by the body without catch or by the catch block run the
+// finally block before being thrown again
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	setupPos := c.emit(code.OpSetupTry, 9999)
+
+	err := c.compileTryBlock(node.Body, node.Finally)
+	if err != nil {
+		return err
+	}
+
+	endJumps := []int{}
+	err = c.compileFinally(node.Finally)
+	if err != nil {
+		return err
+	}
+	endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+	c.changeOperand(setupPos, len(c.currentInstructions()))
+
+	if node.Catch != nil {
+		if node.Param != nil {
+			c.storeSymbol(c.symbolTable.Define(node.Param.Value))
+		} else {
+			c.emit(code.OpPop)
+		}
+
+		if node.Finally == nil {
+			err := c.compileBlockValue(node.Catch)
+			if err != nil {
+				return err
+			}
+		} else {
+			setupPos = c.emit(code.OpSetupTry, 9999)
+
+			err := c.compileTryBlock(node.Catch, node.Finally)
+			if err != nil {
+				return err
+			}
+
+			err = c.compileFinally(node.Finally)
+			if err != nil {
+				return err
+			}
+			endJumps = append(endJumps, c.emit(code.OpJump, 9999))
+
+			c.changeOperand(setupPos, len(c.currentInstructions()))
+		}
+	}
+
+	if node.Finally != nil {
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+
+	end := len(c.currentInstructions())
+	for _, pos := range endJumps {
+		c.changeOperand(pos, end)
+	}
+
+	return nil
+}
+
+// compileTryBlock : compile a block run with a handler set up, leaving its value on the stack, then pop the handler
+func (c *Compiler) compileTryBlock(block *ast.BlockStatement, finally *ast.BlockStatement) error {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = append(scope.tries, &TryScope{finally: finally})
+
+	err := c.compileBlockValue(block)
+	if err != nil {
+		return err
+	}
+
+	scope = &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+
+	c.emit(code.OpPopTry)
+	return nil
+}
+
+// compileFinally : compile the finally block, if any, run after its try or catch block completed normally
+func (c *Compiler) compileFinally(finally *ast.BlockStatement) error {
+	if finally == nil {
+		return nil
+	}
+	return c.Compile(finally)
+}
+
+// unwindTries : before a return, break or continue, pop the handlers of the try blocks it jumps out of, the ones
+// enclosing the code being compiled beyond the first depth, and run their finally blocks
+func (c *Compiler) unwindTries(depth int) error {
+	tries := c.scopes[c.scopeIndex].tries
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		c.emit(code.OpPopTry)
+
+		if tries[i].finally == nil {
+			continue
+		}
+
+		// the finally block runs outside of its try block, a jump out of it only unwinds the enclosing ones
+		c.scopes[c.scopeIndex].tries = tries[:i]
+		err := c.Compile(tries[i].finally)
+		c.scopes[c.scopeIndex].tries = tries
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compileModule : compile an imported module to its own bytecode unit, sharing the loader so that every module is
+// compiled once and import cycles are detected
+func (c *Compiler) compileModule(filename string, program *ast.Program) (object.Object, error) {
+	expanded, err := frontend.New().Process(program)
+	if err != nil {
+		return nil, err
+	}
+
+	comp := New()
+	comp.loader = c.loader
+	comp.optimize = c.optimize
+
+	err = comp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := make(map[string]int)
+	for _, name := range module.Exports(expanded) {
+		symbol, _ := comp.symbolTable.Resolve(name)
+		exports[name] = symbol.Index
+	}
+
+	bytecode := comp.Bytecode()
+	return &object.CompiledModule{
+		Name:         filename,
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+		Constants:    bytecode.Constants,
+		NumGlobals:   comp.symbolTable.numDefinitions,
+		Exports:      exports,
+	}, nil
+}
+
+// compileBlockValue : compile a block used as an expression, leaving on the stack the value of its last expression
+// statement or null
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+	err := c.Compile(block)
+	if err != nil {
+		return err
+	}
+
+	if endsWithExpression(block) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+
+	return nil
+}
+
+// endsWithExpression : report whether the last statement of block is an expression statement, whose compiled code ends
+// with the OpPop discarding its value
+func endsWithExpression(block *ast.BlockStatement) bool {
+	if len(block.Statements) == 0 {
+		return false
+	}
+
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// compileLoopBody : compile the body of a loop starting at offset start, followed by the jump back to start. Break
+// statements in body jump past that jump and continue statements jump to start
+func (c *Compiler) compileLoopBody(body *ast.BlockStatement, start int, depth *Symbol) error {
+	scope := &c.scopes[c.scopeIndex]
+	loop := &LoopScope{continueTarget: start, tries: len(scope.tries), depth: depth}
+	scope.loops = append(scope.loops, loop)
+
+	err := c.Compile(body)
+	if err != nil {
+		return err
+	}
+
+	c.emit(code.OpJump, start)
+
+	scope = &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+
+	end := len(c.currentInstructions())
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, end)
+	}
+
+	return nil
+}
+
+// saveStackDepth : store the stack depth before a loop into a hidden slot when its body breaks or continues inside an
+// expression. Such a jump leaves the operands already pushed by that expression on the stack, so it restores the
+// depth first
+func (c *Compiler) saveStackDepth(body *ast.BlockStatement) *Symbol {
+	if !jumpsInExpression(body) {
+		return nil
+	}
+
+	depth := c.symbolTable.allocate()
+	c.emit(code.OpStackDepth)
+	c.storeSymbol(depth)
+	return &depth
+}
+
+func (c *Compiler) restoreStackDepth(loop *LoopScope) {
+	if loop.depth == nil {
+		return
+	}
+
+	c.loadSymbol(*loop.depth)
+	c.emit(code.OpSetStackDepth)
+}
+
+func (c *Compiler) currentLoop() *LoopScope {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// compileQuote : compile quote(node) to a constant holding node. Unquoting needs the values of the program being
+// compiled, so it is only supported inside macros, which are expanded before compilation
+func (c *Compiler) compileQuote(node *ast.CallExpression) error {
+	if len(node.Arguments) != 1 {
+		return fmt.Errorf("%s: wrong number of arguments to quote: want=1, got=%d", node.Pos(), len(node.Arguments))
+	}
+
+	var unquote ast.Node
+	ast.Modify(ast.Copy(node.Arguments[0]), func(n ast.Node) ast.Node {
+		if call, ok := n.(*ast.CallExpression); ok && call.Function.TokenLiteral() == "unquote" && unquote == nil {
+			unquote = call
+		}
+		return n
+	})
+	if unquote != nil {
+		return fmt.Errorf("%s: unquote can only be used inside macros", unquote.Pos())
+	}
+
+	quote := &object.Quote{Node: node.Arguments[0]}
+	c.emit(code.OpConstant, c.addConstant(quote))
+
 	return nil
 }
 
@@ -341,10 +918,20 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	pos := c.addInstruction(ins)
 
 	c.setLastInstruction(op, pos)
+	c.addSourcePosition(pos)
 
 	return pos
 }
 
+func (c *Compiler) addSourcePosition(pos int) {
+	if !c.position.IsValid() {
+		return
+	}
+
+	sp := code.SourcePosition{Offset: pos, Pos: c.position}
+	c.scopes[c.scopeIndex].sourceMap = append(c.scopes[c.scopeIndex].sourceMap, sp)
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
 	prev := c.scopes[c.scopeIndex].lastInstruction
 	last := EmittedInstruction{Opcode: op, Position: pos}
@@ -377,6 +964,12 @@ func (c *Compiler) removeLastPop() {
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = prev
+
+	sourceMap := c.scopes[c.scopeIndex].sourceMap
+	for len(sourceMap) > 0 && sourceMap[len(sourceMap)-1].Offset >= last.Position {
+		sourceMap = sourceMap[:len(sourceMap)-1]
+	}
+	c.scopes[c.scopeIndex].sourceMap = sourceMap
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -394,6 +987,56 @@ func (c *Compiler) replaceLastPopWithReturn() {
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// markTailCalls : turn the calls of the current scope whose result is returned right away, possibly through jumps to
+// the return as at the end of the branches of an if, into tail calls reusing the frame of the caller. Calls inside try
+// blocks are followed by the instructions leaving the block, so they stay normal calls
+func (c *Compiler) markTailCalls() {
+	ins := c.currentInstructions()
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		next := i + 1 + read
+
+		if code.Opcode(ins[i]) == code.OpCall && returnsAt(ins, next) {
+			c.replaceInstruction(i, code.Make(code.OpTailCall, operands[0]))
+		}
+
+		i = next
+	}
+}
+
+// returnsAt : report whether the instruction at pos returns the value on top of the stack, after following the
+// unconditional jumps leading to it
+func returnsAt(ins code.Instructions, pos int) bool {
+	// a chain of jumps is at most as long as the instructions, a longer one is a cycle
+	for steps := 0; pos < len(ins) && steps < len(ins); steps++ {
+		switch code.Opcode(ins[pos]) {
+		case code.OpReturnValue:
+			return true
+		case code.OpJump:
+			pos = int(code.ReadUint16(ins[pos+1:]))
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// optimizeInstructions : run the peephole optimizer over the instructions of the current scope, once they are all
+// emitted, then fuse them into superinstructions
+func (c *Compiler) optimizeInstructions(keepPops bool) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.instructions, scope.sourceMap = code.Optimize(scope.instructions, scope.sourceMap, keepPops)
+	scope.instructions, scope.sourceMap = code.Fuse(scope.instructions, scope.sourceMap)
+	scope.lastInstruction = EmittedInstruction{}
+	scope.prevInstruction = EmittedInstruction{}
+}
+
 func (c *Compiler) changeOperand(opPos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[opPos])
 	newInstruction := code.Make(op, operand)
@@ -401,6 +1044,100 @@ func (c *Compiler) changeOperand(opPos int, operand int) {
 	c.replaceInstruction(opPos, newInstruction)
 }
 
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
+	}
+}
+
+// captureSymbol : push the variable captured by a closure being created. Local and free variables are pushed as the
+// cells holding them, so that the closure shares them with the scope it is created in
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+// assignsTo : report whether node assigns to the variable name anywhere, nested functions included
+func assignsTo(node ast.Node, name string) bool {
+	found := false
+	ast.Modify(node, func(n ast.Node) ast.Node {
+		if assign, ok := n.(*ast.AssignExpression); ok {
+			if ident, ok := assign.Target.(*ast.Identifier); ok && ident.Value == name {
+				found = true
+			}
+		}
+		return n
+	})
+	return found
+}
+
+// jumpsInExpression : report whether a break or continue in the loop body block may run with values pushed on the
+// stack. Statements, and the blocks of if and try expressions used as statements, leave nothing on the stack. Jumps in
+// the bodies of nested loops belong to those loops
+func jumpsInExpression(block *ast.BlockStatement) bool {
+	for _, stmt := range block.Statements {
+		switch stmt := stmt.(type) {
+		case *ast.BreakStatement, *ast.ContinueStatement:
+			continue
+		case *ast.WhileStatement:
+			if jumpsOut(stmt.Condition) {
+				return true
+			}
+			continue
+		case *ast.ForStatement:
+			if jumpsOut(stmt.Iterable) {
+				return true
+			}
+			continue
+		case *ast.ExpressionStatement:
+			switch exp := stmt.Expression.(type) {
+			case *ast.IfExpression:
+				if jumpsOut(exp.Condition) || jumpsInExpression(exp.Consequence) ||
+					exp.Alternative != nil && jumpsInExpression(exp.Alternative) {
+					return true
+				}
+				continue
+			case *ast.TryExpression:
+				// finally runs with the value of the try expression pushed
+				if jumpsInExpression(exp.Body) || exp.Catch != nil && jumpsInExpression(exp.Catch) ||
+					exp.Finally != nil && jumpsOut(exp.Finally) {
+					return true
+				}
+				continue
+			}
+		}
+
+		if jumpsOut(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+// jumpsOut : report whether node contains a break or continue statement
+func jumpsOut(node ast.Node) bool {
+	found := false
+	ast.Modify(node, func(n ast.Node) ast.Node {
+		switch n.(type) {
+		case *ast.BreakStatement, *ast.ContinueStatement:
+			found = true
+		}
+		return n
+	})
+	return found
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
@@ -419,11 +1156,13 @@ func (c *Compiler) loadSymbol(s Symbol) {
 func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
+		SourceMap:    c.scopes[c.scopeIndex].sourceMap,
 		Constants:    c.constants,
 	}
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
+	SourceMap    code.SourceMap
 	Constants    []object.Object
 }
@@ -14,6 +14,7 @@ type compilerTestCase struct {
 	input                string
 	expectedConstants    []interface{}
 	expectedInstructions []code.Instructions
+	optimize             bool // compile the optimized program, the expectations are otherwise the code as written
 }
 
 func TestIntegerArithmetic(t *testing.T) {
@@ -68,6 +69,16 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "5 % 2",
+			expectedConstants: []interface{}{5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
 		{
 			input:             "-1",
 			expectedConstants: []interface{}{1},
@@ -82,6 +93,32 @@ func TestIntegerArithmetic(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-2.5e3",
+			expectedConstants: []interface{}{2500.0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -112,11 +149,31 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -174,6 +231,41 @@ func TestBooleanExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 && 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpJumpNotTruthy, 14), // 0003
+				code.Make(code.OpConstant, 1),       // 0006
+				code.Make(code.OpBang),              // 0009
+				code.Make(code.OpBang),              // 0010
+				code.Make(code.OpJump, 15),          // 0011
+				code.Make(code.OpFalse),             // 0014
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+		{
+			input:             "1 || 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),       // 0000
+				code.Make(code.OpJumpNotTruthy, 10), // 0003
+				code.Make(code.OpTrue),              // 0006
+				code.Make(code.OpJump, 15),          // 0007
+				code.Make(code.OpConstant, 1),       // 0010
+				code.Make(code.OpBang),              // 0013
+				code.Make(code.OpBang),              // 0014
+				code.Make(code.OpPop),               // 0015
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -221,6 +313,221 @@ func TestConditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				while (true) { 1; break; }
+				2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 14), // 0001
+				code.Make(code.OpConstant, 0),       // 0004
+				code.Make(code.OpPop),               // 0007
+				code.Make(code.OpJump, 14),          // 0008
+				code.Make(code.OpJump, 0),           // 0011
+				code.Make(code.OpConstant, 1),       // 0014
+				code.Make(code.OpPop),               // 0017
+			},
+		},
+		{
+			input: `
+				for (x in [1]) { continue; }
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),  // 0000
+				code.Make(code.OpArray, 1),     // 0003
+				code.Make(code.OpIter),         // 0006
+				code.Make(code.OpSetGlobal, 0), // 0007
+				code.Make(code.OpGetGlobal, 0), // 0010
+				code.Make(code.OpIterNext, 25), // 0013
+				code.Make(code.OpSetGlobal, 1), // 0016
+				code.Make(code.OpJump, 10),     // 0019
+				code.Make(code.OpJump, 10),     // 0022
+			},
+		},
+		{
+			input: `
+				while (true) { [1, if (true) { continue; }]; }
+			`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpStackDepth),        // 0000
+				code.Make(code.OpSetGlobal, 0),      // 0001
+				code.Make(code.OpTrue),              // 0004
+				code.Make(code.OpJumpNotTruthy, 34), // 0005
+				code.Make(code.OpConstant, 0),       // 0008
+				code.Make(code.OpTrue),              // 0011
+				code.Make(code.OpJumpNotTruthy, 26), // 0012
+				code.Make(code.OpGetGlobal, 0),      // 0015
+				code.Make(code.OpSetStackDepth),     // 0018
+				code.Make(code.OpJump, 4),           // 0019
+				code.Make(code.OpNull),              // 0022
+				code.Make(code.OpJump, 27),          // 0023
+				code.Make(code.OpNull),              // 0026
+				code.Make(code.OpArray, 2),          // 0027
+				code.Make(code.OpPop),               // 0030
+				code.Make(code.OpJump, 4),           // 0031
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				try { 1 } catch (e) { 2 };
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpSetupTry, 10), // 0000
+				code.Make(code.OpConstant, 0),  // 0003
+				code.Make(code.OpPopTry),       // 0006
+				code.Make(code.OpJump, 16),     // 0007
+				code.Make(code.OpSetGlobal, 0), // 0010
+				code.Make(code.OpConstant, 1),  // 0013
+				code.Make(code.OpPop),          // 0016
+			},
+		},
+		{
+			input: `
+				try { 1 } catch (e) { 2 } finally { 3 };
+			`,
+			expectedConstants: []interface{}{1, 3, 2, 3, 3},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpSetupTry, 14), // 0000
+				code.Make(code.OpConstant, 0),  // 0003
+				code.Make(code.OpPopTry),       // 0006
+				code.Make(code.OpConstant, 1),  // 0007
+				code.Make(code.OpPop),          // 0010
+				code.Make(code.OpJump, 36),     // 0011
+				code.Make(code.OpSetGlobal, 0), // 0014
+				code.Make(code.OpSetupTry, 31), // 0017
+				code.Make(code.OpConstant, 2),  // 0020
+				code.Make(code.OpPopTry),       // 0023
+				code.Make(code.OpConstant, 3),  // 0024
+				code.Make(code.OpPop),          // 0027
+				code.Make(code.OpJump, 36),     // 0028
+				code.Make(code.OpConstant, 4),  // 0031
+				code.Make(code.OpPop),          // 0034
+				code.Make(code.OpThrow),        // 0035
+				code.Make(code.OpPop),          // 0036
+			},
+		},
+		{
+			input: `
+				while (true) { try { break; } finally { 1 } }
+			`,
+			expectedConstants: []interface{}{1, 1, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),              // 0000
+				code.Make(code.OpJumpNotTruthy, 33), // 0001
+				code.Make(code.OpSetupTry, 24),      // 0004
+				code.Make(code.OpPopTry),            // 0007
+				code.Make(code.OpConstant, 0),       // 0008
+				code.Make(code.OpPop),               // 0011
+				code.Make(code.OpJump, 33),          // 0012
+				code.Make(code.OpNull),              // 0015
+				code.Make(code.OpPopTry),            // 0016
+				code.Make(code.OpConstant, 1),       // 0017
+				code.Make(code.OpPop),               // 0020
+				code.Make(code.OpJump, 29),          // 0021
+				code.Make(code.OpConstant, 2),       // 0024
+				code.Make(code.OpPop),               // 0027
+				code.Make(code.OpThrow),             // 0028
+				code.Make(code.OpPop),               // 0029
+				code.Make(code.OpJump, 0),           // 0030
+			},
+		},
+		{
+			input: `
+				throw "boom";
+			`,
+			expectedConstants: []interface{}{"boom"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpThrow),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+				let x = 1;
+				x = 2;
+			`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				let a = [1];
+				a[0] = 2;
+			`,
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+				fn() {
+					let c = 0;
+					fn() { c = 1 }
+				}
+			`,
+			expectedConstants: []interface{}{
+				0,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -581,6 +888,181 @@ func TestFunctionCalls(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `let f = fn(a, b = a, ...rest) { rest }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpJumpIfProvided, 1, 8),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input: `fn(a = 1, b = 2) { }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpJumpIfProvided, 0, 9),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpJumpIfProvided, 1, 18),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+
+	program := parse(`let f = fn(a, b = a, ...rest) { rest }`)
+	compiler := New()
+	if err := compiler.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn, ok := compiler.Bytecode().Constants[0].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant is not CompiledFunction. got=%T", compiler.Bytecode().Constants[0])
+	}
+	if fn.NumParameters != 2 || fn.NumDefaults != 1 || !fn.Variadic || fn.NumLocals != 3 || fn.Name != "f" {
+		t.Errorf("wrong function header. got NumParameters=%d NumDefaults=%d Variadic=%t NumLocals=%d Name=%q",
+			fn.NumParameters, fn.NumDefaults, fn.Variadic, fn.NumLocals, fn.Name)
+	}
+}
+
+func TestLetPatterns(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let x = []; let [a, [b], ...c] = x;`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpUnpackArray, 2, 1),
+				code.Make(code.OpSetGlobal, 1),
+				code.Make(code.OpUnpackArray, 1, 0),
+				code.Make(code.OpSetGlobal, 2),
+				code.Make(code.OpSetGlobal, 3),
+			},
+		},
+		{
+			input: `fn(h) { let {name, size: [w, l]} = h; w }`,
+			expectedConstants: []interface{}{
+				"name",
+				"size",
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpUnpackHash, 2),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpUnpackArray, 2, 0),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpSetLocal, 3),
+					code.Make(code.OpGetLocal, 2),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(x) { if (x) { len(x) } else { return len([x]) } }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),       // 0000
+					code.Make(code.OpJumpNotTruthy, 14), // 0002
+					code.Make(code.OpGetBuiltin, 0),     // 0005
+					code.Make(code.OpGetLocal, 0),       // 0007
+					code.Make(code.OpTailCall, 1),       // 0009
+					code.Make(code.OpJump, 25),          // 0011
+					code.Make(code.OpGetBuiltin, 0),     // 0014
+					code.Make(code.OpGetLocal, 0),       // 0016
+					code.Make(code.OpArray, 1),          // 0018
+					code.Make(code.OpTailCall, 1),       // 0021
+					code.Make(code.OpReturnValue),       // 0023
+					code.Make(code.OpNull),              // 0024
+					code.Make(code.OpReturnValue),       // 0025
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(x) { len(x) + 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetBuiltin, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 1),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(x) { try { return len(x) } catch (e) { 0 } }`,
+			expectedConstants: []interface{}{
+				0,
+				[]code.Instructions{
+					code.Make(code.OpSetupTry, 16),  // 0000
+					code.Make(code.OpGetBuiltin, 0), // 0003
+					code.Make(code.OpGetLocal, 0),   // 0005
+					code.Make(code.OpCall, 1),       // 0007
+					code.Make(code.OpPopTry),        // 0009
+					code.Make(code.OpReturnValue),   // 0010
+					code.Make(code.OpNull),          // 0011
+					code.Make(code.OpPopTry),        // 0012
+					code.Make(code.OpJump, 21),      // 0013
+					code.Make(code.OpSetLocal, 1),   // 0016
+					code.Make(code.OpConstant, 0),   // 0018
+					code.Make(code.OpReturnValue),   // 0021
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestLetStatementScopes(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -683,7 +1165,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -715,7 +1197,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -745,13 +1227,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -797,15 +1279,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -838,7 +1320,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -869,7 +1351,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 0),
 					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 				1,
@@ -878,7 +1360,7 @@ func TestRecursiveFunctions(t *testing.T) {
 					code.Make(code.OpSetLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpConstant, 2),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -895,6 +1377,98 @@ func TestRecursiveFunctions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestOptimizedPrograms(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2 * 3; 4",
+			expectedConstants: []interface{}{4},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input:             `let s = "a" + "b"; if (1 > 2) { s } else { 20 }`,
+			expectedConstants: []interface{}{"ab", 20},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input: "fn(x) { if (!false) { x + 1 - 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocalAddConstant, 0, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input: "fn(n, g) { if (n < 2) { return n; } g(n - 2) + g() }",
+			expectedConstants: []interface{}{
+				2,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpCompareJumpNotTruthy, int(code.OpLessThan), 12),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpGetLocalSubConstant, 0, 1),
+					code.Make(code.OpCall1),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpCall0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+			optimize: true,
+		},
+		{
+			input: "fn(x) { if (!x) { let y = 1; } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpTruthy, 12),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+			optimize: true,
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestCompilerScopes(t *testing.T) {
 	compiler := New()
 	if compiler.scopeIndex != 0 {
@@ -960,6 +1534,7 @@ func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 		program := parse(tt.input)
 
 		compiler := New()
+		compiler.SetOptimize(tt.optimize)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -1017,6 +1592,11 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s", i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
@@ -1038,6 +1618,19 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
+}
+
 func testIntegerObject(expected int64, actual object.Object) error {
 	result, ok := actual.(*object.Integer)
 	if !ok {
@@ -1069,3 +1662,76 @@ func parse(input string) *ast.Program {
 	p := parser.New(l)
 	return p.ParseProgram()
 }
+
+func TestCompilerErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 1;\nx + y", "2:5: undefined variable y"},
+		{"fn() {\n  foo()\n}", "2:3: undefined variable foo"},
+		{"let f = fn() {\n  macro(x) { x }\n}", "2:3: macros can only be defined by top-level let statements"},
+		{"quote(1 + unquote(2))", "1:18: unquote can only be used inside macros"},
+		{"let x = 1;\ny = x", "2:1: undefined variable y"},
+		{"len = 1", "1:1: cannot assign to builtin len"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. expected=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	input := "1 +\n2;\nfn() { 3 }"
+
+	compiler := New()
+	compiler.SetOptimize(false)
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	tests := []struct {
+		offset      int
+		expectedPos string
+	}{
+		{0, "1:1"},  // OpConstant 0
+		{3, "2:1"},  // OpConstant 1
+		{6, "1:3"},  // OpAdd
+		{7, "1:1"},  // OpPop
+		{8, "3:1"},  // OpClosure
+		{12, "3:1"}, // OpPop
+	}
+
+	for _, tt := range tests {
+		pos, ok := bytecode.SourceMap.Lookup(tt.offset)
+		if !ok {
+			t.Fatalf("no source position for offset %d", tt.offset)
+		}
+		if pos.String() != tt.expectedPos {
+			t.Errorf("wrong position for offset %d. want=%q, got=%q", tt.offset, tt.expectedPos, pos)
+		}
+	}
+
+	fn, ok := bytecode.Constants[3].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 3 is not a function. got=%T", bytecode.Constants[3])
+	}
+
+	pos, ok := fn.SourceMap.Lookup(0)
+	if !ok || pos.String() != "3:8" {
+		t.Errorf("wrong position for function body. want=%q, got=%q", "3:8", pos)
+	}
+}
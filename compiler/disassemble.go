@@ -0,0 +1,211 @@
+package compiler
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+	"sort"
+)
+
+// Disassemble : return a human readable listing of the main program followed by every compiled function constant,
+// each function listed after the code creating its closures. OpConstant and OpClosure operands are resolved to the
+// constants they refer to and jump targets are labelled. Imported modules are listed last, the same way
+func Disassemble(bytecode *Bytecode) string {
+	d := &disassembler{modules: make(map[string]bool)}
+	d.listUnit("", bytecode.Instructions, bytecode.Constants)
+	return d.out.String()
+}
+
+type disassembler struct {
+	out       bytes.Buffer
+	prefix    string // prefix of the headers, naming the module being listed
+	constants []object.Object
+	listed    map[int]bool    // function constants already listed
+	modules   map[string]bool // modules already listed, by name
+}
+
+// listUnit : list the main code of a program or module followed by its functions and the modules it imports
+func (d *disassembler) listUnit(prefix string, ins code.Instructions, constants []object.Object) {
+	d.prefix = prefix
+	d.constants = constants
+	d.listed = make(map[int]bool)
+
+	d.listFunction("main", ins)
+
+	// functions not reachable from main, e.g. left in a constants pool shared with previous programs
+	for i, constant := range constants {
+		if _, ok := constant.(*object.CompiledFunction); ok {
+			d.listConstantFunction(i)
+		}
+	}
+
+	for _, constant := range constants {
+		if mod, ok := constant.(*object.CompiledModule); ok && !d.modules[mod.Name] {
+			d.modules[mod.Name] = true
+			d.listUnit(fmt.Sprintf("module %q ", mod.Name), mod.Instructions, mod.Constants)
+		}
+	}
+}
+
+func (d *disassembler) listConstantFunction(index int) {
+	if d.listed[index] {
+		return
+	}
+	d.listed[index] = true
+
+	fn := d.constants[index].(*object.CompiledFunction)
+	header := fmt.Sprintf("fn[%d] params=%d locals=%d", index, fn.NumParameters, fn.NumLocals)
+	if fn.NumDefaults > 0 {
+		header += fmt.Sprintf(" defaults=%d", fn.NumDefaults)
+	}
+	if fn.Variadic {
+		header += " variadic"
+	}
+	d.listFunction(header, fn.Instructions)
+}
+
+func (d *disassembler) listFunction(header string, ins code.Instructions) {
+	if d.out.Len() > 0 {
+		d.out.WriteString("\n")
+	}
+	fmt.Fprintf(&d.out, "== %s%s ==\n", d.prefix, header)
+
+	labels := jumpLabels(ins)
+	closures := []int{}
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&d.out, "%04d ERROR: %s\n", i, err)
+			break
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		if label, ok := labels[i]; ok {
+			fmt.Fprintf(&d.out, "%s:\n", label)
+		}
+
+		text := fmt.Sprintf("%04d %s", i, formatInstruction(def, operands))
+		comment := d.comment(code.Opcode(ins[i]), operands, labels)
+		if comment != "" {
+			fmt.Fprintf(&d.out, "%-32s ; %s\n", text, comment)
+		} else {
+			fmt.Fprintf(&d.out, "%s\n", text)
+		}
+
+		if code.Opcode(ins[i]) == code.OpClosure {
+			closures = append(closures, operands[0])
+		}
+
+		i += 1 + read
+	}
+
+	if label, ok := labels[len(ins)]; ok {
+		fmt.Fprintf(&d.out, "%s:\n", label)
+	}
+
+	for _, index := range closures {
+		if d.isFunction(index) {
+			d.listConstantFunction(index)
+		}
+	}
+}
+
+// comment : resolve the operands of an instruction to the constants and labels they refer to
+func (d *disassembler) comment(op code.Opcode, operands []int, labels map[int]string) string {
+	if i, ok := code.JumpOperand(op); ok {
+		if op == code.OpCompareJumpNotTruthy {
+			def, err := code.Lookup(byte(operands[0]))
+			if err != nil {
+				return "<invalid comparison> -> " + labels[operands[i]]
+			}
+			return def.Name + " -> " + labels[operands[i]]
+		}
+		return "-> " + labels[operands[i]]
+	}
+
+	switch op {
+	case code.OpConstant:
+		if operands[0] >= len(d.constants) {
+			return "<invalid constant>"
+		}
+		return describeConstant(d.constants[operands[0]])
+	case code.OpGetLocalAddConstant, code.OpGetLocalSubConstant:
+		if operands[1] >= len(d.constants) {
+			return "<invalid constant>"
+		}
+		return describeConstant(d.constants[operands[1]])
+	case code.OpClosure:
+		if !d.isFunction(operands[0]) {
+			return "<invalid function>"
+		}
+		return fmt.Sprintf("fn[%d], %d free", operands[0], operands[1])
+	case code.OpImport:
+		if operands[0] >= len(d.constants) {
+			return "<invalid module>"
+		}
+		return d.constants[operands[0]].Inspect()
+	}
+
+	return ""
+}
+
+func (d *disassembler) isFunction(index int) bool {
+	if index >= len(d.constants) {
+		return false
+	}
+	_, ok := d.constants[index].(*object.CompiledFunction)
+	return ok
+}
+
+// jumpLabels : assign labels L0, L1, ... to the jump targets of an instruction stream, in order of offset
+func jumpLabels(ins code.Instructions) map[int]string {
+	targets := []int{}
+	seen := make(map[int]bool)
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			break
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		if j, ok := code.JumpOperand(code.Opcode(ins[i])); ok && !seen[operands[j]] {
+			seen[operands[j]] = true
+			targets = append(targets, operands[j])
+		}
+
+		i += 1 + read
+	}
+
+	sort.Ints(targets)
+
+	labels := make(map[int]string, len(targets))
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i)
+	}
+
+	return labels
+}
+
+func formatInstruction(def *code.Definition, operands []int) string {
+	var out bytes.Buffer
+
+	out.WriteString(def.Name)
+	for _, o := range operands {
+		fmt.Fprintf(&out, " %d", o)
+	}
+
+	return out.String()
+}
+
+func describeConstant(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.String:
+		return fmt.Sprintf("%q", obj.Value)
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,107 @@
+package compiler
+
+import (
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `
+		let f = fn(a) {
+			let g = fn(b, c = a, ...rest) { if (b) { "yes" } else { c } };
+			g
+		};
+		f(1);
+	`
+
+	expected := `== main ==
+0000 OpClosure 2 0               ; fn[2], 0 free
+0004 OpSetGlobal 0
+0007 OpGetGlobal 0
+0010 OpConstant 3                ; 1
+0013 OpCall 1
+0015 OpPop
+
+== fn[2] params=1 locals=2 ==
+0000 OpCaptureLocal 0
+0002 OpClosure 1 1               ; fn[1], 1 free
+0006 OpSetLocal 1
+0008 OpGetLocal 1
+0010 OpReturnValue
+
+== fn[1] params=2 locals=3 defaults=1 variadic ==
+0000 OpJumpIfProvided 1 8        ; -> L0
+0004 OpGetFree 0
+0006 OpSetLocal 1
+L0:
+0008 OpGetLocal 0
+0010 OpJumpNotTruthy 19          ; -> L1
+0013 OpConstant 0                ; "yes"
+0016 OpJump 21                   ; -> L2
+L1:
+0019 OpGetLocal 1
+L2:
+0021 OpReturnValue
+`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	compiler := New()
+	compiler.SetOptimize(false)
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	actual := Disassemble(compiler.Bytecode())
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
+
+func TestDisassembleSuperinstructions(t *testing.T) {
+	input := "let f = fn(n) { if (n < 2) { return n; } f(n - 1) + f(n - 2) }; f(3)"
+
+	expected := `== main ==
+0000 OpClosure 3 0               ; fn[3], 0 free
+0004 OpSetGlobal 0
+0007 OpGetGlobal 0
+0010 OpConstant 4                ; 3
+0013 OpCall1
+0014 OpPop
+
+== fn[3] params=1 locals=1 ==
+0000 OpGetLocal 0
+0002 OpConstant 0                ; 2
+0005 OpCompareJumpNotTruthy 36 12 ; OpLessThan -> L0
+0009 OpGetLocal 0
+0011 OpReturnValue
+L0:
+0012 OpCurrentClosure
+0013 OpGetLocalSubConstant 0 1   ; 1
+0017 OpCall1
+0018 OpCurrentClosure
+0019 OpGetLocalSubConstant 0 2   ; 2
+0023 OpCall1
+0024 OpAdd
+0025 OpReturnValue
+`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	actual := Disassemble(compiler.Bytecode())
+	if actual != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, actual)
+	}
+}
@@ -0,0 +1,441 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"monkey/code"
+	"monkey/object"
+	"monkey/token"
+	"sort"
+)
+
+// Bytecode files start with a fixed header: the magic bytes, the format version (big endian uint16) and the CRC-32
+// checksum of the payload (big endian uint32). The payload holds the main instructions with their source map followed
+// by the constants pool. Integers inside the payload are varint encoded. The version changes with the opcodes or the
+// constant tags, so that files written with other ones are rejected rather than misread.
+const (
+	BytecodeMagic   = "MNKY"
+	BytecodeVersion = 13
+
+	headerLen = len(BytecodeMagic) + 2 + 4
+)
+
+// constant tags identifying the object type of each serialized constant. Floats are stored as their IEEE 754 bits
+// (big endian uint64). Modules are stored with their own instructions and constants, followed by their exports sorted
+// by name
+const (
+	tagInteger byte = iota + 1
+	tagString
+	tagCompiledFunction
+	tagFloat
+	tagModule
+)
+
+var ErrChecksumMismatch = errors.New("bytecode checksum mismatch")
+
+// quoteError : a quote constant, which bytecode files cannot hold since it is a piece of syntax tree. It is reported
+// at the position of the quoted code rather than as a constant
+type quoteError struct {
+	pos token.Position
+}
+
+func (e *quoteError) Error() string {
+	return fmt.Sprintf("%s: quote cannot be compiled to a bytecode file, run the source file instead", e.pos)
+}
+
+// constantError : the error writing constant i, unless it is a quoteError, which is returned as is
+func constantError(i int, err error) error {
+	var quote *quoteError
+	if errors.As(err, &quote) {
+		return quote
+	}
+	return fmt.Errorf("constant %d: %s", i, err)
+}
+
+// IsBytecode : report whether data starts with the bytecode file magic bytes
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BytecodeMagic))
+}
+
+// MarshalBinary : serialize the bytecode into the versioned and checksummed on-disk format
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	e := &encoder{files: make(map[string]int)}
+
+	e.writeInstructions(b.Instructions, b.SourceMap)
+
+	e.writeUvarint(uint64(len(b.Constants)))
+	for i, constant := range b.Constants {
+		err := e.writeConstant(constant)
+		if err != nil {
+			return nil, constantError(i, err)
+		}
+	}
+
+	payload := e.buf.Bytes()
+
+	out := make([]byte, headerLen, headerLen+len(payload))
+	copy(out, BytecodeMagic)
+	binary.BigEndian.PutUint16(out[len(BytecodeMagic):], BytecodeVersion)
+	binary.BigEndian.PutUint32(out[len(BytecodeMagic)+2:], crc32.ChecksumIEEE(payload))
+
+	return append(out, payload...), nil
+}
+
+// UnmarshalBinary : load bytecode previously serialized by MarshalBinary, validating its header and checksum
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	if !IsBytecode(data) {
+		return fmt.Errorf("not a Monkey bytecode file")
+	}
+	if len(data) < headerLen {
+		return fmt.Errorf("truncated bytecode header")
+	}
+
+	version := binary.BigEndian.Uint16(data[len(BytecodeMagic):])
+	if version != BytecodeVersion {
+		return fmt.Errorf("unsupported bytecode version %d, want %d", version, BytecodeVersion)
+	}
+
+	payload := data[headerLen:]
+	checksum := binary.BigEndian.Uint32(data[len(BytecodeMagic)+2:])
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return ErrChecksumMismatch
+	}
+
+	d := &decoder{data: payload}
+
+	instructions, sourceMap := d.readInstructions()
+
+	numConstants := d.readLength()
+	constants := make([]object.Object, 0, numConstants)
+	for i := 0; i < numConstants && d.err == nil; i++ {
+		constants = append(constants, d.readConstant())
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("unexpected %d trailing bytes in bytecode", len(d.data)-d.pos)
+	}
+
+	b.Instructions = instructions
+	b.SourceMap = sourceMap
+	b.Constants = constants
+
+	return nil
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	files map[string]int // file names already written, by index of first appearance
+}
+
+func (e *encoder) writeUvarint(v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+func (e *encoder) writeVarint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	e.buf.Write(tmp[:n])
+}
+
+func (e *encoder) writeUint64(v uint64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	e.buf.Write(tmp[:])
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeUvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// writeFilename : write a file name as an index into the table of names seen so far, followed by the name itself
+// the first time it appears
+func (e *encoder) writeFilename(name string) {
+	if index, ok := e.files[name]; ok {
+		e.writeUvarint(uint64(index))
+		return
+	}
+
+	index := len(e.files)
+	e.files[name] = index
+	e.writeUvarint(uint64(index))
+	e.writeString(name)
+}
+
+func (e *encoder) writeInstructions(ins code.Instructions, sourceMap code.SourceMap) {
+	e.writeBytes(ins)
+
+	e.writeUvarint(uint64(len(sourceMap)))
+	for _, sp := range sourceMap {
+		e.writeUvarint(uint64(sp.Offset))
+		e.writeFilename(sp.Pos.Filename)
+		e.writeUvarint(uint64(sp.Pos.Offset))
+		e.writeUvarint(uint64(sp.Pos.Line))
+		e.writeUvarint(uint64(sp.Pos.Column))
+	}
+}
+
+func (e *encoder) writeConstant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.writeVarint(obj.Value)
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		e.writeUint64(math.Float64bits(obj.Value))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.writeString(obj.Value)
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagCompiledFunction)
+		e.writeInstructions(obj.Instructions, obj.SourceMap)
+		e.writeUvarint(uint64(obj.NumLocals))
+		e.writeUvarint(uint64(obj.NumParameters))
+		e.writeUvarint(uint64(obj.NumDefaults))
+		variadic := byte(0)
+		if obj.Variadic {
+			variadic = 1
+		}
+		e.buf.WriteByte(variadic)
+		e.writeString(obj.Name)
+	case *object.CompiledModule:
+		e.buf.WriteByte(tagModule)
+		e.writeString(obj.Name)
+		e.writeInstructions(obj.Instructions, obj.SourceMap)
+
+		e.writeUvarint(uint64(len(obj.Constants)))
+		for i, constant := range obj.Constants {
+			err := e.writeConstant(constant)
+			if err != nil {
+				return fmt.Errorf("module %s: %w", obj.Name, constantError(i, err))
+			}
+		}
+
+		e.writeUvarint(uint64(obj.NumGlobals))
+
+		names := make([]string, 0, len(obj.Exports))
+		for name := range obj.Exports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		e.writeUvarint(uint64(len(names)))
+		for _, name := range names {
+			e.writeString(name)
+			e.writeUvarint(uint64(obj.Exports[name]))
+		}
+	case *object.Quote:
+		return &quoteError{pos: obj.Node.Pos()}
+	default:
+		return fmt.Errorf("cannot serialize constant of type %s", obj.Type())
+	}
+
+	return nil
+}
+
+// decoder : reads the payload sequentially. The first error is kept in err and every later read is a no-op
+type decoder struct {
+	data  []byte
+	pos   int
+	err   error
+	files []string
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, a...)
+	}
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.pos >= len(d.data) {
+		d.fail("unexpected end of bytecode")
+		return 0
+	}
+
+	b := d.data[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("malformed varint at offset %d", d.pos)
+		return 0
+	}
+
+	d.pos += n
+	return v
+}
+
+func (d *decoder) readVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(d.data[d.pos:])
+	if n <= 0 {
+		d.fail("malformed varint at offset %d", d.pos)
+		return 0
+	}
+
+	d.pos += n
+	return v
+}
+
+func (d *decoder) readUint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.data)-d.pos < 8 {
+		d.fail("unexpected end of bytecode")
+		return 0
+	}
+
+	v := binary.BigEndian.Uint64(d.data[d.pos:])
+	d.pos += 8
+	return v
+}
+
+// readLength : read a count or size, rejecting values that cannot fit in the remaining payload
+func (d *decoder) readLength() int {
+	v := d.readUvarint()
+	if v > uint64(len(d.data)-d.pos) {
+		d.fail("invalid length %d at offset %d", v, d.pos)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readLength()
+	if d.err != nil {
+		return nil
+	}
+
+	b := make([]byte, n)
+	copy(b, d.data[d.pos:d.pos+n])
+	d.pos += n
+	return b
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readFilename() string {
+	index := int(d.readUvarint())
+
+	switch {
+	case d.err != nil:
+		return ""
+	case index < len(d.files):
+		return d.files[index]
+	case index == len(d.files):
+		name := d.readString()
+		d.files = append(d.files, name)
+		return name
+	default:
+		d.fail("invalid file name index %d", index)
+		return ""
+	}
+}
+
+func (d *decoder) readInstructions() (code.Instructions, code.SourceMap) {
+	ins := code.Instructions(d.readBytes())
+
+	n := d.readLength()
+	if n == 0 {
+		return ins, nil
+	}
+
+	sourceMap := make(code.SourceMap, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		offset := int(d.readUvarint())
+		pos := token.Position{Filename: d.readFilename()}
+		pos.Offset = int(d.readUvarint())
+		pos.Line = int(d.readUvarint())
+		pos.Column = int(d.readUvarint())
+
+		sourceMap = append(sourceMap, code.SourcePosition{Offset: offset, Pos: pos})
+	}
+
+	return ins, sourceMap
+}
+
+func (d *decoder) readConstant() object.Object {
+	tag := d.readByte()
+	if d.err != nil {
+		return nil
+	}
+
+	switch tag {
+	case tagInteger:
+		return &object.Integer{Value: d.readVarint()}
+	case tagFloat:
+		return &object.Float{Value: math.Float64frombits(d.readUint64())}
+	case tagString:
+		return &object.String{Value: d.readString()}
+	case tagCompiledFunction:
+		ins, sourceMap := d.readInstructions()
+		numLocals := int(d.readUvarint())
+		numParameters := int(d.readUvarint())
+		numDefaults := int(d.readUvarint())
+		variadic := d.readByte() != 0
+
+		return &object.CompiledFunction{
+			Instructions:  ins,
+			SourceMap:     sourceMap,
+			NumLocals:     numLocals,
+			NumParameters: numParameters,
+			NumDefaults:   numDefaults,
+			Variadic:      variadic,
+			Name:          d.readString(),
+		}
+	case tagModule:
+		mod := &object.CompiledModule{Name: d.readString()}
+		mod.Instructions, mod.SourceMap = d.readInstructions()
+
+		numConstants := d.readLength()
+		mod.Constants = make([]object.Object, 0, numConstants)
+		for i := 0; i < numConstants && d.err == nil; i++ {
+			mod.Constants = append(mod.Constants, d.readConstant())
+		}
+
+		mod.NumGlobals = int(d.readUvarint())
+
+		numExports := d.readLength()
+		mod.Exports = make(map[string]int, numExports)
+		for i := 0; i < numExports && d.err == nil; i++ {
+			name := d.readString()
+			mod.Exports[name] = int(d.readUvarint())
+		}
+
+		return mod
+	default:
+		d.fail("unknown constant tag %d", tag)
+		return nil
+	}
+}
@@ -0,0 +1,163 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"reflect"
+	"testing"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	input := `
+		let greeting = "hello";
+		let ratio = 2.5e-3;
+		let newAdder = fn(a, b = 2, ...rest) {
+			let c = a + b;
+			fn(d) { c + d - 1000000 }
+		};
+		newAdder(1, -2)(3);
+		puts(greeting);
+	`
+
+	l := lexer.NewWithFile(input, "roundtrip.mk")
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	bytecode := compiler.Bytecode()
+
+	data, err := bytecode.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %s", err)
+	}
+
+	if !IsBytecode(data) {
+		t.Fatalf("serialized bytecode does not start with the magic bytes")
+	}
+
+	decoded := &Bytecode{}
+	err = decoded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("UnmarshalBinary failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(bytecode.Instructions, decoded.Instructions) {
+		t.Errorf("wrong instructions.\nwant=%q\ngot=%q", bytecode.Instructions, decoded.Instructions)
+	}
+
+	if !reflect.DeepEqual(bytecode.SourceMap, decoded.SourceMap) {
+		t.Errorf("wrong source map.\nwant=%+v\ngot=%+v", bytecode.SourceMap, decoded.SourceMap)
+	}
+
+	if len(decoded.Constants) != len(bytecode.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(bytecode.Constants), len(decoded.Constants))
+	}
+
+	for i, want := range bytecode.Constants {
+		got := decoded.Constants[i]
+
+		switch want := want.(type) {
+		case *object.CompiledFunction:
+			fn, ok := got.(*object.CompiledFunction)
+			if !ok {
+				t.Fatalf("constant %d - not a function: %T", i, got)
+			}
+			if !reflect.DeepEqual(want, fn) {
+				t.Errorf("constant %d - wrong function.\nwant=%+v\ngot=%+v", i, want, fn)
+			}
+		default:
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("constant %d - wrong value. want=%s, got=%s", i, want.Inspect(), got.Inspect())
+			}
+		}
+	}
+}
+
+// TestBytecodeVersion : pin the number of opcodes of the current format. A new opcode changes the encoding, and needs
+// a new BytecodeVersion along with the update of this test
+func TestBytecodeVersion(t *testing.T) {
+	opcodes := 0
+	for op := 0; op < 256; op++ {
+		if _, err := code.Lookup(byte(op)); err == nil {
+			opcodes++
+		}
+	}
+
+	if BytecodeVersion != 13 || opcodes != 68 {
+		t.Errorf("opcodes changed without a new bytecode version. version=%d, opcodes=%d", BytecodeVersion, opcodes)
+	}
+}
+
+func TestBytecodeQuote(t *testing.T) {
+	l := lexer.NewWithFile("let f = fn() {\n  quote(1 + x)\n};", "quote.mk")
+	p := parser.New(l)
+
+	compiler := New()
+	err := compiler.Compile(p.ParseProgram())
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	_, err = compiler.Bytecode().MarshalBinary()
+	expected := "quote.mk:2:11: quote cannot be compiled to a bytecode file, run the source file instead"
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
+
+func TestBytecodeUnmarshalErrors(t *testing.T) {
+	compiler := New()
+	err := compiler.Compile(parse(`let a = fn(x) { x * 2 }; a(21)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	data, err := compiler.Bytecode().MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %s", err)
+	}
+
+	corrupt := func(modify func(d []byte) []byte) []byte {
+		d := make([]byte, len(data))
+		copy(d, data)
+		return modify(d)
+	}
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("let a = 1;"), "not a Monkey bytecode file"},
+		{[]byte(BytecodeMagic + "\x00"), "truncated bytecode header"},
+		{
+			corrupt(func(d []byte) []byte { d[len(BytecodeMagic)+1] = 99; return d }),
+			fmt.Sprintf("unsupported bytecode version 99, want %d", BytecodeVersion),
+		},
+		{
+			corrupt(func(d []byte) []byte { d[len(d)-1] ^= 0xff; return d }),
+			ErrChecksumMismatch.Error(),
+		},
+		{
+			corrupt(func(d []byte) []byte { return d[:len(d)-3] }),
+			ErrChecksumMismatch.Error(),
+		},
+	}
+
+	for i, tt := range tests {
+		err := (&Bytecode{}).UnmarshalBinary(tt.data)
+		if err == nil {
+			t.Fatalf("tests[%d] - expected error, got none", i)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("tests[%d] - wrong error. want=%q, got=%q", i, tt.expected, err)
+		}
+	}
+}
@@ -38,14 +38,23 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 }
 
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions, Scope: GlobalScope}
+	symbol := s.allocate()
+	symbol.Name = name
+
+	s.store[name] = symbol
+	return symbol
+}
+
+// allocate : reserve a global or local slot that cannot be resolved by name, for values the compiler keeps between
+// instructions such as the iterator of a for loop
+func (s *SymbolTable) allocate() Symbol {
+	symbol := Symbol{Index: s.numDefinitions, Scope: GlobalScope}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
 		symbol.Scope = LocalScope
 	}
 
-	s.store[name] = symbol
 	s.numDefinitions++
 	return symbol
 }
@@ -72,6 +81,22 @@ func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	return symbol
 }
 
+// ResolveBinding : resolve name to the variable it is bound to. Unlike Resolve, the name of the function being compiled
+// resolves to the variable of the enclosing scope the function is assigned to rather than to the function itself
+func (s *SymbolTable) ResolveBinding(name string) (Symbol, bool) {
+	obj, ok := s.store[name]
+	if !ok || obj.Scope != FunctionScope {
+		return s.Resolve(name)
+	}
+
+	obj, ok = s.Outer.ResolveBinding(name)
+	if !ok || obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+		return obj, ok
+	}
+
+	return s.defineFree(obj), true
+}
+
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
@@ -0,0 +1,338 @@
+package conformance
+
+import (
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/frontend"
+	"monkey/lexer"
+	"monkey/module"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// conformanceTest : a program and the inspected value of its last expression, which both engines must produce
+type conformanceTest struct {
+	input    string
+	expected string
+}
+
+func TestEquality(t *testing.T) {
+	tests := []conformanceTest{
+		{`"a" == "a"`, "true"},
+		{`"a" != "a"`, "false"},
+		{`"a" == "b"`, "false"},
+		{`let s = "mon"; s + "key" == "monkey"`, "true"},
+		{`"1" == 1`, "false"},
+		{"1 == 1.0", "true"},
+		{"true == true", "true"},
+		{"true == 1", "false"},
+		{"[] == []", "true"},
+		{"[1, 2] == [1, 2]", "true"},
+		{"[1, 2] == [2, 1]", "false"},
+		{"[1, 2] == [1, 2, 3]", "false"},
+		{`[1, ["a", [true]]] == [1, ["a", [true]]]`, "true"},
+		{`[1, ["a", [true]]] != [1, ["a", [false]]]`, "true"},
+		{"{} == {}", "true"},
+		{`{"a": 1, "b": [2]} == {"b": [2], "a": 1}`, "true"},
+		{`{"a": 1} == {"a": 2}`, "false"},
+		{`{"a": 1} == {"b": 1}`, "false"},
+		{`{"a": 1} == ["a", 1]`, "false"},
+		{"let f = fn() { 1 }; f == f", "true"},
+		{"fn() { 1 } == fn() { 1 }", "false"},
+		{"[][0] == [1][5]", "true"},
+		{"[][0] == false", "false"},
+		{"len == len", "true"},
+		{`{1: "a"}[1.0]`, "a"},
+		{`{2.0: "a"}[2]`, "a"},
+		{`{1.5: "a"}[1]`, "null"},
+		{"let a = [0]; a[0] = a; a == a", "true"},
+		{"let a = [0]; a[0] = a; a != a", "false"},
+		{"let a = [0]; a[0] = a; let b = [0]; b[0] = b; a == b", "true"},
+		{"let a = [0, 1]; a[0] = a; let b = [0, 2]; b[0] = b; a != b", "true"},
+		{`let h = {"a": 1}; h["self"] = h; let g = {"a": 1}; g["self"] = g; h == g`, "true"},
+		{`let h = {"a": 1}; h["self"] = h; let g = {"a": 2}; g["self"] = g; h != g`, "true"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestPrograms(t *testing.T) {
+	tests := []conformanceTest{
+		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", "50"},
+		{"7 % 3 + 7.5 % 2", "2.5"},
+		{`"日本" + "語"`, "日本語"},
+		{`len("héllo")`, "5"},
+		{`let h = {"a": [1, 2]}; h["a"][1]`, "2"},
+		{"if (1 > 2) { 10 }", "null"},
+		{"let x = 0; while (x < 10) { x = x + 3 }; x", "12"},
+		{"let s = 0; for (x in [1, 2, 3, 4]) { if (x % 2 == 0) { continue; } s = s + x }; s", "4"},
+		{`let keys = []; for (k in {"b": 1, "a": 2}) { keys = push(keys, k) }; keys`, "[a, b]"},
+		{"let counter = fn() { let c = 0; fn() { c = c + 1 } }; let next = counter(); next(); next()", "2"},
+		{"let a = [1, 2, 3]; a[0] = a[1] + a[2]; a", "[5, 2, 3]"},
+		{"let f = fn() { f = 5; f }; f()", "5"},
+		{"let f = fn() { let r = f; f = 5; [r == f, f] }; f()", "[false, 5]"},
+		{"let g = fn() { let f = fn(n) { if (n == 0) { f = 7; return f; } f(n - 1) }; f(2) }; g()", "7"},
+		{"let calls = 0; let f = fn() { calls = calls + 1; true }; false && f(); true || f(); calls", "0"},
+		{"let log = []; let f = fn(x) { log = push(log, x); x }; f(1) < f(2); f(3) >= f(4); log", "[1, 2, 3, 4]"},
+		{
+			`let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } };
+			fib(15)`,
+			"610",
+		},
+		{
+			`let map = fn(arr, f) {
+				let iter = fn(arr, acc) {
+					if (len(arr) == 0) { acc } else { iter(rest(arr), push(acc, f(first(arr)))) }
+				};
+				iter(arr, []);
+			};
+			map([1, 2, 3], fn(x) { x * x })`,
+			"[1, 4, 9]",
+		},
+		{
+			`let unless = macro(cond, cons, alt) { quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) }) };
+			unless(1 > 2, "yes", "no")`,
+			"yes",
+		},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+// TestJumpsInExpressions : a return, break or continue inside an expression ends the expression, as well as the
+// statement holding it
+func TestJumpsInExpressions(t *testing.T) {
+	tests := []conformanceTest{
+		{"let n = 0; let i = 0; while (i < 5) { i = i + 1; let x = if (i == 2) { break; }; n = n + 1 }; [i, n]", "[2, 1]"},
+		{"let out = []; for (i in [1, 2, 3]) { out = push(out, [if (i == 2) { continue; } else { i }]) }; out", "[[1], [3]]"},
+		{"let s = 0; for (x in [1, 2, 3]) { s = s + x + if (x == 2) { break; } else { 0 } }; s", "1"},
+		{"let g = fn(a, b) { a }; let s = 0; for (x in [1, 2, 3]) { s = s + g(x, if (x == 2) { continue; }) }; s", "4"},
+		{"let h = {}; for (x in [1, 2]) { h[x] = -if (x == 2) { break; } else { x } }; h", "{1: -1}"},
+		{"let n = 0; for (x in [1, 2, 3]) { let i = 0; while (if (x == 2) { continue; } else { i < 1 }) { i = i + 1; n = n + 1 } }; n", "2"},
+		{"let f = fn(c) { let y = if (c) { return 9; }; 1 }; [f(true), f(false)]", "[9, 1]"},
+		{"let f = fn() { 1 + if (true) { return 5; } else { 2 } }; f()", "5"},
+		{"let f = fn() { [1, if (true) { return [2]; }] }; f()", "[2]"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []conformanceTest{
+		{`try { 1 + true } catch (e) { e["type"] }`, "TypeError"},
+		{`try { -"a" } catch (e) { e["type"] }`, "TypeError"},
+		{`try { [1][true] } catch (e) { e["type"] }`, "TypeError"},
+		{`try { {}[[]] } catch (e) { e["type"] }`, "TypeError"},
+		{`try { 5() } catch (e) { e["type"] }`, "TypeError"},
+		{`try { for (x in 1) {} } catch (e) { e["type"] }`, "TypeError"},
+		{`try { let a = [1]; a[3] = 0 } catch (e) { e["type"] }`, "IndexError"},
+		{`try { 1 / 0 } catch (e) { e["type"] }`, "ZeroDivisionError"},
+		{`try { push([]) } catch (e) { e["type"] }`, "ArgumentError"},
+		{`try { throw "oops" } catch (e) { [e["type"], e["message"]] }`, "[Error, oops]"},
+		{`let log = []; try { try { throw "a" } finally { log = push(log, 1) } } catch (e) { log = push(log, 2) }; log`, "[1, 2]"},
+		{`let f = fn(x) { try { if (x) { throw "no" } else { "yes" } } catch (e) { e["message"] } }; [f(false), f(true)]`, "[yes, no]"},
+		{`let n = 0; let f = fn() { let i = 0; while (true) { i = i + 1; try { if (i == 3) { return i } } finally { n = n + 10 } } }; [f(), n]`, "[3, 30]"},
+		{`let e = try { len(1) } catch (err) { err }; let again = try { throw e } catch (err) { err }; again == e`, "true"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestFunctionParameters(t *testing.T) {
+	tests := []conformanceTest{
+		{`let f = fn(a, b = a * 2, ...rest) { [a, b, rest] }; [f(1), f(1, 5), f(1, 5, 6, 7)]`, "[[1, 2, []], [1, 5, []], [1, 5, [6, 7]]]"},
+		{`let f = fn(a = []) { push(a, 1) }; f(); f()`, "[1]"},
+		{`let greet = fn(name, greeting = "hello") { greeting + " " + name }; greet("monkey")`, "hello monkey"},
+		{`let f = fn(a, g = fn() { a }) { a = a + 1; g() }; f(1)`, "2"},
+		{`let f = fn(a = 1 / 0) { a }; [f(3), try { f() } catch (e) { e["type"] }]`, "[3, ZeroDivisionError]"},
+		{`let f = fn(a, b = 2) { a }; try { f() } catch (e) { e["message"] }`, "wrong number of arguments to f: want=1 to 2, got=0"},
+		{`try { fn(...rest) { rest }(1)(2) } catch (e) { e["type"] }`, "TypeError"},
+		{`try { fn(a, ...rest) { a }() } catch (e) { e["message"] }`, "wrong number of arguments to anonymous function: want=at least 1, got=0"},
+		{`let a = arity(fn(a, b = 1, ...c) { a }); [a["min"], a["max"]]`, "[1, -1]"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestLetPatterns(t *testing.T) {
+	tests := []conformanceTest{
+		{`let [a, [b, c], ...rest] = [1, [2, 3], 4, 5]; [a, b, c, rest]`, "[1, 2, 3, [4, 5]]"},
+		{`let {name, address: {city}} = {"name": "Monkey", "address": {"city": "Rome"}}; name + " " + city`, "Monkey Rome"},
+		{`let {type, message} = try { [][0] = 1 } catch (e) { e }; [type, message]`, "[IndexError, index out of range: 0]"},
+		{`let x = 1; let [x, y] = [x + 1, x]; [x, y]`, "[2, 1]"},
+		{`try { let [a, b] = [1, 2, 3] } catch (e) { [e["type"], e["message"]] }`, "[PatternError, wrong number of elements to destructure: want=2, got=3]"},
+		{`try { let {a: [b]} = {"a": {}} } catch (e) { e["message"] }`, "cannot destructure HASH with an array pattern"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestConstantExpressions(t *testing.T) {
+	tests := []conformanceTest{
+		{`1 + 2 * 3 - -4 / 2`, "9"},
+		{`[7 % 3, 1 < 2, 2 >= 3, 1 == 1, 1 != 1]`, "[1, true, false, true, false]"},
+		{`"mon" + "key" == "monkey"`, "true"},
+		{`let x = 5; [!0, !"", !true, true == false, true && 0, false || "", false && x, true || x]`, "[false, false, false, false, true, true, false, true]"},
+		{`9223372036854775807 + 1`, "-9223372036854775808"},
+		{`[try { 1 / 0 } catch (e) { e["type"] }, try { 1 % (2 - 2) } catch (e) { e["type"] }]`, "[ZeroDivisionError, ZeroDivisionError]"},
+		{`try { "a" - "b" } catch (e) { e["type"] }`, "TypeError"},
+		{`try { -true } catch (e) { e["type"] }`, "TypeError"},
+		{`if (1 > 2) { 10 } else { 20 }`, "20"},
+		{`if (true) { let a = 1; a + 1 } else { 0 }`, "2"},
+		{`let a = 1; if ("yes") { a = a + 1 }; if (false) { a = 10 }; a`, "2"},
+		{`let f = fn(n) { if (false) { return 0 }; if (true) { return n * 2 }; n }; f(3)`, "6"},
+		{`let f = fn() { 1; "a"; [2, {"b": !3}]; 4 }; f()`, "4"},
+		{`let n = 0; let f = fn() { n = n + 1 }; [f(), 2]; n`, "1"},
+		{`let q = quote(1 + 2); q`, "QUOTE((1 + 2))"},
+	}
+
+	runConformanceTests(t, tests, nil)
+}
+
+func TestModules(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"math.mk": `
+			let twice = macro(x) { quote(unquote(x) * 2) };
+			export let square = fn(x) { x * x };
+			export let double = fn(x) { twice(x) };
+			let secret = 42;
+			export let answer = secret;
+		`,
+		"counter.mk": `
+			export let state = {"loads": 0};
+			state["loads"] = state["loads"] + 1;
+			let count = 0;
+			export let next = fn() { count = count + 1; count };
+		`,
+		"util.mk": `
+			let m = import "math";
+			let c = import "./counter";
+			export let sumSquares = fn(a, b) { m["square"](a) + m["square"](b) };
+		`,
+		"callback.mk": `export let apply = fn(f, x) { f(x) };`,
+		"broken.mk":   `export let x = 1 / 0;`,
+		"point.mk":    `export let [x, {y}] = [1, {"y": 2}];`,
+		"loop.mk":     `let step = 2; export let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + step) } };`,
+	})
+
+	tests := []conformanceTest{
+		{`let m = import "math"; m["answer"]`, "42"},
+		{`let m = import "math"; m["secret"]`, "null"},
+		{`let m = import "math"; m["double"](21)`, "42"},
+		{`let keys = []; for (k in import "math") { keys = push(keys, k) }; keys`, "[answer, double, square]"},
+		{`let u = import "util"; u["sumSquares"](3, 4)`, "25"},
+		{`let c = import "counter"; let u = import "util"; import "counter.mk"; c["state"]["loads"]`, "1"},
+		{`let c = import "counter"; c["next"](); c["next"]()`, "2"},
+		{`let k = 10; let cb = import "callback"; cb["apply"](fn(x) { x + k }, 5)`, "15"},
+		{`let f = fn() { import "math" }; f()["square"](5)`, "25"},
+		{`try { import "broken" } catch (e) { [e["type"], e["message"]] }`, "[ZeroDivisionError, division by zero]"},
+		{`let {x, y} = import "point"; [x, y]`, "[1, 2]"},
+		{`let {count} = import "loop"; let step = 5; let f = fn(n) { count(n, step) }; f(3000)`, "6005"},
+	}
+
+	runConformanceTests(t, tests, []string{dir})
+}
+
+// writeFiles : create the files, given by names relative to a new temporary directory, and return the directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "monkey-conformance")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	return dir
+}
+
+// runConformanceTests : run each test on both engines, the VM running the program compiled with and without the
+// optimizer, looking up the modules it imports in searchPath
+func runConformanceTests(t *testing.T, tests []conformanceTest, searchPath []string) {
+	t.Helper()
+
+	for _, tt := range tests {
+		evaluated := runEvaluator(t, tt.input, module.NewLoader(searchPath))
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("evaluator: wrong result for %q. expected=%s, got=%s", tt.input, tt.expected, evaluated.Inspect())
+		}
+
+		executed := runVM(t, tt.input, module.NewLoader(searchPath), true)
+		if executed.Inspect() != tt.expected {
+			t.Errorf("vm: wrong result for %q. expected=%s, got=%s", tt.input, tt.expected, executed.Inspect())
+		}
+
+		executed = runVM(t, tt.input, module.NewLoader(searchPath), false)
+		if executed.Inspect() != tt.expected {
+			t.Errorf("vm unoptimized: wrong result for %q. expected=%s, got=%s", tt.input, tt.expected, executed.Inspect())
+		}
+	}
+}
+
+func runEvaluator(t *testing.T, input string, loader *module.Loader) object.Object {
+	t.Helper()
+
+	env := object.NewEnvironment()
+	env.SetImporter(evaluator.NewImporter(loader))
+
+	result := evaluator.Eval(process(t, input), env)
+	if result == nil {
+		t.Fatalf("evaluator: no result for %q", input)
+	}
+	if ex, ok := result.(*object.Exception); ok {
+		t.Fatalf("evaluator: error for %q: %s", input, ex.Inspect())
+	}
+
+	return result
+}
+
+func runVM(t *testing.T, input string, loader *module.Loader, optimize bool) object.Object {
+	t.Helper()
+
+	comp := compiler.New()
+	comp.SetLoader(loader)
+	comp.SetOptimize(optimize)
+	err := comp.Compile(process(t, input))
+	if err != nil {
+		t.Fatalf("compiler error for %q: %s", input, err)
+	}
+
+	machine := vm.New(comp.Bytecode())
+	err = machine.Run()
+	if err != nil {
+		t.Fatalf("vm error for %q: %s", input, err)
+	}
+
+	return machine.LastPoppedStackElem()
+}
+
+// process : parse and macro-expand input
+func process(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors())
+	}
+
+	expanded, err := frontend.New().Process(program)
+	if err != nil {
+		t.Fatalf("macro expansion failed for %q: %s", input, err)
+	}
+
+	return expanded
+}
@@ -0,0 +1,5 @@
+// package conformance
+// holds the tests every Monkey program must pass with the same result on both the tree-walking evaluator and the
+// compiler and VM
+
+package conformance
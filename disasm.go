@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/compiler"
+	"monkey/module"
+	"os"
+)
+
+// disasmCommand : implements `monkey disasm <file>`, printing the bytecode of a source or bytecode file
+func disasmCommand(args []string) int {
+	fs := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	path := pathFlag(fs)
+	optimize := optimizeFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: monkey disasm <file> [--path dirs] [--optimize=false]\n")
+	}
+
+	files, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	var bytecode *compiler.Bytecode
+	if compiler.IsBytecode(data) {
+		bytecode, err = loadBytecode(files[0])
+	} else {
+		program, ok := loadProgram(files[0])
+		if !ok {
+			return 1
+		}
+		bytecode, err = compileProgram(program, module.NewLoader(module.SplitPath(*path)), *optimize)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	fmt.Print(compiler.Disassemble(bytecode))
+	return 0
+}
@@ -7,6 +7,7 @@ package evaluator
 
 import (
 	"fmt"
+	"math"
 	"monkey/ast"
 	"monkey/object"
 )
@@ -15,6 +16,9 @@ var (
 	NULL  = &object.Null{}
 	TRUE  = &object.Boolean{Value: true}
 	FALSE = &object.Boolean{Value: false}
+
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
 // Eval : given a Node from the AST, evaluate it and return its object representation
@@ -30,89 +34,134 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalBlockStatement(node.Statements, env)
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 	case *ast.LetStatement:
 		val := Eval(node.Value, env)
-		if isError(val) {
+		if isAbrupt(val) {
 			return val
 		}
+		if node.Pattern != nil {
+			return bindPattern(node.Pattern, val, env)
+		}
 		env.Set(node.Name.Value, val)
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return withPosition(evalThrow(val), node)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 
 	// Expressions
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.Identifier:
-		return evalIdentifier(node, env)
+		return withPosition(evalIdentifier(node, env), node)
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return withPosition(evalPrefixExpression(node.Operator, right), node)
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, left, env)
+		}
+
 		right := Eval(node.Right, env)
-		if isError(right) {
+		if isAbrupt(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return withPosition(evalInfixExpression(node.Operator, left, right), node)
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
+	case *ast.TryExpression:
+		return evalTryExpression(node, env)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Body: body, Env: env}
+		return &object.Function{
+			Parameters: params,
+			Defaults:   node.Defaults,
+			Rest:       node.Rest,
+			Body:       body,
+			Env:        env,
+			Name:       node.Name,
+		}
 	case *ast.CallExpression:
 		if node.Function.TokenLiteral() == "quote" {
 			return quote(node.Arguments[0], env)
 		}
 
 		function := Eval(node.Function, env)
-		if isError(function) {
+		if isAbrupt(function) {
 			return function
 		}
 		args := evalExpressions(node.Arguments, env)
-		if len(args) == 1 && isError(args[0]) {
+		if len(args) == 1 && isAbrupt(args[0]) {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		return withPosition(applyFunction(function, args), node)
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
-		if len(elements) == 1 && isError(elements[0]) {
+		if len(elements) == 1 && isAbrupt(elements[0]) {
 			return elements[0]
 		}
 		return &object.Array{Elements: elements}
 	case *ast.IndexExpression:
 		left := Eval(node.Left, env)
-		if isError(left) {
+		if isAbrupt(left) {
 			return left
 		}
 		index := Eval(node.Index, env)
-		if isError(index) {
+		if isAbrupt(index) {
 			return index
 		}
-		return evalIndexExpression(left, index)
+		return withPosition(evalIndexExpression(left, index), node)
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return withPosition(evalHashLiteral(node, env), node)
+	case *ast.AssignExpression:
+		return evalAssignExpression(node, env)
+	case *ast.ImportExpression:
+		return evalImportExpression(node, env)
 	}
 
 	return nil
 }
 
-func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+// newError : return an exception raising a new error of the given kind
+func newError(kind, format string, a ...interface{}) *object.Exception {
+	return &object.Exception{Error: &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}}
+}
+
+// withPosition : attach the source position of node to an error raised while evaluating it, unless it already has one
+func withPosition(obj object.Object, node ast.Node) object.Object {
+	if ex, ok := obj.(*object.Exception); ok && !ex.Error.Pos.IsValid() {
+		ex.Error.Pos = node.Pos()
+	}
+	return obj
 }
 
 func nativeBoolToBooleanObject(boolean bool) *object.Boolean {
@@ -122,6 +171,20 @@ func nativeBoolToBooleanObject(boolean bool) *object.Boolean {
 	return FALSE
 }
 
+// evalLogicalExpression : evaluate && and || given their left operand, evaluating the right one only when it decides
+// the result. The result is always a boolean
+func evalLogicalExpression(node *ast.InfixExpression, left object.Object, env *object.Environment) object.Object {
+	if isTruthy(left) == (node.Operator == "||") {
+		return nativeBoolToBooleanObject(isTruthy(left))
+	}
+
+	right := Eval(node.Right, env)
+	if isAbrupt(right) {
+		return right
+	}
+	return nativeBoolToBooleanObject(isTruthy(right))
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj {
 	case NULL:
@@ -135,13 +198,20 @@ func isTruthy(obj object.Object) bool {
 	}
 }
 
-func isError(obj object.Object) bool {
-	if obj != nil {
-		return obj.Type() == object.ERROR_OBJ
+// isAbrupt : report whether obj ends the evaluation of the enclosing expressions early, being an error thrown or the
+// signal of a return, break or continue statement. The statement handling it receives it unchanged. Errors caught by a
+// try expression are ordinary values
+func isAbrupt(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Exception, *object.ReturnValue, *object.Break, *object.Continue:
+		return true
+	default:
+		return false
 	}
-	return false
 }
 
+// evalProgram : run the statements of a program, returning the value of the last one. An error left uncaught stops
+// the program and is returned as the exception throwing it, which tells it apart from a caught error value
 func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
@@ -151,7 +221,7 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
-		case *object.Error:
+		case *object.Exception:
 			return result
 		}
 	}
@@ -165,11 +235,8 @@ func evalBlockStatement(stmts []ast.Statement, env *object.Environment) object.O
 	for _, stmt := range stmts {
 		result = Eval(stmt, env)
 
-		if result != nil {
-			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
-				return result
-			}
+		if isAbrupt(result) {
+			return result
 		}
 	}
 
@@ -183,7 +250,7 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 	case "-":
 		return evalMinusPrefixOperatorExpression(right)
 	default:
-		return newError("unknown operator: %s%s", operator, right.Type())
+		return newError(object.TYPE_ERROR, "unknown operator: %s%s", operator, right.Type())
 	}
 }
 
@@ -192,27 +259,32 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
-		return newError("unknown operator: -%s", right.Type())
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
+		return newError(object.TYPE_ERROR, "unknown operator: -%s", right.Type())
 	}
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
-	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
-		return evalStringInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right):
+		return evalFloatInfixExpression(operator, left, right)
 	case operator == "==":
-		return nativeBoolToBooleanObject(left == right)
+		return nativeBoolToBooleanObject(object.Equal(left, right))
 	case operator == "!=":
-		return nativeBoolToBooleanObject(left != right)
+		return nativeBoolToBooleanObject(!object.Equal(left, right))
+	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
+		return evalStringInfixExpression(operator, left, right)
 	case left.Type() != right.Type():
-		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
@@ -228,17 +300,78 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
 		return nativeBoolToBooleanObject(leftVal != rightVal)
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// evalFloatInfixExpression : evaluate an operation between two numbers, at least one of which is a float. Integers
+// are converted to floats
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError(object.TYPE_ERROR, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
 	}
 }
 
@@ -249,7 +382,7 @@ func evalStringInfixExpression(operator string, left, right object.Object) objec
 		rightVal := right.(*object.String).Value
 		return &object.String{Value: leftVal + rightVal}
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return newError(object.TYPE_ERROR, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 
 }
@@ -257,19 +390,116 @@ func evalStringInfixExpression(operator string, left, right object.Object) objec
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
 	condition := Eval(ie.Condition, env)
 
-	if isError(condition) {
+	if isAbrupt(condition) {
 		return condition
 	}
 
 	if isTruthy(condition) {
-		return Eval(ie.Consequence, env)
+		return blockValue(Eval(ie.Consequence, env))
 	} else if ie.Alternative != nil {
-		return Eval(ie.Alternative, env)
+		return blockValue(Eval(ie.Alternative, env))
 	} else {
 		return NULL
 	}
 }
 
+// blockValue : the value of a block used as an expression, null when the block does not end with an expression
+func blockValue(obj object.Object) object.Object {
+	if obj == nil {
+		return NULL
+	}
+	return obj
+}
+
+// evalThrow : raise a caught error again, or a new error with the thrown string as message
+func evalThrow(val object.Object) object.Object {
+	switch val := val.(type) {
+	case *object.Error:
+		return &object.Exception{Error: val}
+	case *object.String:
+		return newError(object.USER_ERROR, "%s", val.Value)
+	default:
+		return newError(object.TYPE_ERROR, "cannot throw %s, only ERROR or STRING", val.Type())
+	}
+}
+
+// evalTryExpression : evaluate the body, then the catch block if the body threw an error, binding the error to the
+// catch parameter. The finally block runs last whatever happened, a return, break, continue or error in it replacing
+// the result
+func evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := blockValue(Eval(te.Body, env))
+
+	if ex, ok := result.(*object.Exception); ok && te.Catch != nil {
+		if te.Param != nil {
+			env.Set(te.Param.Value, ex.Error)
+		}
+		result = blockValue(Eval(te.Catch, env))
+	}
+
+	if te.Finally != nil {
+		switch final := Eval(te.Finally, env); final.(type) {
+		case *object.ReturnValue, *object.Break, *object.Continue, *object.Exception:
+			return final
+		}
+	}
+
+	return result
+}
+
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isAbrupt(condition) {
+			return condition
+		}
+
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		if result, done := evalLoopBody(ws.Body, env); done {
+			return result
+		}
+	}
+}
+
+func evalForStatement(fs *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := Eval(fs.Iterable, env)
+	if isAbrupt(iterable) {
+		return iterable
+	}
+
+	iterator, ok := object.NewIterator(iterable)
+	if !ok {
+		return withPosition(newError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type()), fs.Iterable)
+	}
+
+	for item, ok := iterator.Next(); ok; item, ok = iterator.Next() {
+		env.Set(fs.Variable.Value, item)
+
+		if result, done := evalLoopBody(fs.Body, env); done {
+			return result
+		}
+	}
+
+	return nil
+}
+
+// evalLoopBody : run one iteration of a loop. Reports whether the loop is over, either because of a break or
+// because a return value or an error has to be propagated
+func evalLoopBody(body *ast.BlockStatement, env *object.Environment) (object.Object, bool) {
+	result := Eval(body, env)
+
+	switch result.(type) {
+	case *object.Break:
+		return nil, true
+	case *object.ReturnValue, *object.Exception:
+		return result, true
+	default:
+		return nil, false
+	}
+}
+
 func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
 	if val, ok := env.Get(node.Value); ok {
 		return val
@@ -278,7 +508,7 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 		return builtin
 	}
 
-	return newError("identifier not found: " + node.Value)
+	return newError(object.NAME_ERROR, "identifier not found: "+node.Value)
 }
 
 func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Object {
@@ -286,7 +516,7 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 
 	for _, e := range exps {
 		evaluated := Eval(e, env)
-		if isError(evaluated) {
+		if isAbrupt(evaluated) {
 			return []object.Object{evaluated}
 		}
 		result = append(result, evaluated)
@@ -298,27 +528,94 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 func applyFunction(fn object.Object, args []object.Object) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
-		extendedEnv := extendedFunctionEnv(fn, args)
+		extendedEnv, err := extendedFunctionEnv(fn, args)
+		if err != nil {
+			return unwrapReturnValue(err)
+		}
 		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		return blockValue(unwrapReturnValue(evaluated))
 	case *object.Builtin:
 		if result := fn.Fn(args...); result != nil {
 			return result
 		}
 		return NULL
 	default:
-		return newError("not a function: %s", fn.Type())
+		return newError(object.TYPE_ERROR, "not a function: %s", fn.Type())
 	}
 }
 
-func extendedFunctionEnv(fn *object.Function, args []object.Object) *object.Environment {
+// extendedFunctionEnv : bind the arguments to the parameters of fn in a new environment. The default values of the
+// missing arguments are evaluated in it, so they can refer to the parameters before them, and the extra arguments are
+// collected into an array bound to the rest parameter
+func extendedFunctionEnv(fn *object.Function, args []object.Object) (*object.Environment, object.Object) {
+	if arity := fn.Arity(); !arity.Accepts(len(args)) {
+		return nil, &object.Exception{Error: object.NewArityError(fn.Name, arity, len(args))}
+	}
+
 	env := object.NewEnclosedEnvironment(fn.Env)
 
 	for i, param := range fn.Parameters {
-		env.Set(param.Value, args[i])
+		if i < len(args) {
+			env.Set(param.Value, args[i])
+			continue
+		}
+
+		value := Eval(fn.Defaults[i], env)
+		if isAbrupt(value) {
+			return nil, value
+		}
+		env.Set(param.Value, value)
 	}
 
-	return env
+	if fn.Rest != nil {
+		rest := []object.Object{}
+		if len(args) > len(fn.Parameters) {
+			rest = append(rest, args[len(fn.Parameters):]...)
+		}
+		env.Set(fn.Rest.Value, &object.Array{Elements: rest})
+	}
+
+	return env, nil
+}
+
+// bindPattern : bind the identifiers of a destructuring pattern to the parts of value they match. Returns an exception
+// pointing to the (nested) pattern value does not match, nil otherwise
+func bindPattern(pattern ast.Pattern, value object.Object, env *object.Environment) object.Object {
+	var targets []ast.Pattern
+	var values []object.Object
+	var err *object.Error
+
+	switch pattern := pattern.(type) {
+	case *ast.Identifier:
+		env.Set(pattern.Value, value)
+		return nil
+	case *ast.ArrayPattern:
+		targets = pattern.Elements
+		if pattern.Rest != nil {
+			targets = append(targets[:len(targets):len(targets)], pattern.Rest)
+		}
+		values, err = object.UnpackArray(value, len(pattern.Elements), pattern.Rest != nil)
+	case *ast.HashPattern:
+		keys := make([]string, len(pattern.Keys))
+		for i, key := range pattern.Keys {
+			keys[i] = key.Value
+		}
+		targets = pattern.Values
+		values, err = object.UnpackHash(value, keys)
+	}
+
+	if err != nil {
+		err.Pos = pattern.Pos()
+		return &object.Exception{Error: err}
+	}
+
+	for i, target := range targets {
+		if result := bindPattern(target, values[i], env); result != nil {
+			return result
+		}
+	}
+
+	return nil
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
@@ -333,10 +630,17 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
+	case left.Type() == object.ERROR_OBJ:
+		if field, ok := left.(*object.Error).Field(index); ok {
+			return field
+		}
+		return NULL
 	default:
-		return newError("index operator not supported: %s", left.Type())
+		return newError(object.TYPE_ERROR, "index operator not supported: %s", left.Type())
 	}
 }
 
@@ -352,22 +656,96 @@ func evalArrayIndexExpression(array, index object.Object) object.Object {
 	return arrayObject.Elements[idx]
 }
 
+// evalStringIndexExpression : return the character at index as a string. Strings are indexed by character, not by byte
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	chars := []rune(str.(*object.String).Value)
+	idx := index.(*object.Integer).Value
+	max := int64(len(chars) - 1)
+
+	if idx < 0 || idx > max {
+		return NULL
+	}
+
+	return &object.String{Value: string(chars[idx])}
+}
+
+// evalAssignExpression : assign to the innermost existing binding of a variable, or to an element of an array or hash
+func evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+
+		if _, ok := env.Assign(target.Value, val); ok {
+			return val
+		}
+		if _, ok := builtins[target.Value]; ok {
+			return withPosition(newError(object.NAME_ERROR, "cannot assign to builtin %s", target.Value), target)
+		}
+		return withPosition(newError(object.NAME_ERROR, "identifier not found: "+target.Value), target)
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isAbrupt(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isAbrupt(index) {
+			return index
+		}
+		val := Eval(node.Value, env)
+		if isAbrupt(val) {
+			return val
+		}
+		return withPosition(evalIndexAssignment(left, index, val), target)
+	default:
+		return withPosition(newError(object.TYPE_ERROR, "invalid assignment target %s", node.Target.String()), node)
+	}
+}
+
+func evalIndexAssignment(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError(object.TYPE_ERROR, "array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError(object.INDEX_ERROR, "index out of range: %d", idx.Value)
+		}
+
+		left.Elements[idx.Value] = val
+		return val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+		return val
+	default:
+		return newError(object.TYPE_ERROR, "index assignment not supported: %s", left.Type())
+	}
+}
+
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 
 	for keyNode, valueNode := range node.Pairs {
 		key := Eval(keyNode, env)
-		if isError(key) {
+		if isAbrupt(key) {
 			return key
 		}
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return newError("unusable as hash key: %s", key.Type())
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
 		}
 
 		value := Eval(valueNode, env)
-		if isError(value) {
+		if isAbrupt(value) {
 			return value
 		}
 
@@ -382,7 +760,7 @@ func evalHashIndexExpression(hash, index object.Object) object.Object {
 	hashObject := hash.(*object.Hash)
 	key, ok := index.(object.Hashable)
 	if !ok {
-		return newError("unusable as hash key: %s", index.Type())
+		return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
 	}
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
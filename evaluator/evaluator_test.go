@@ -37,6 +37,9 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"10 - 3 % 2 * 4", 6},
 	}
 
 	for _, tt := range tests {
@@ -60,6 +63,45 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1e3", 1000},
+		{"1.5 + 1.5", 3},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"3 - 0.5 * 2", 2},
+		{"7 / 2.0", 3.5},
+		{"2.5 * -2", -5},
+		{"7.5 % 2", 1.5},
+		{"-7 % 2.5", -2},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+
+	if result.Value != expected {
+		t.Errorf("object has wrong value. expected=%g, got=%g", expected, result.Value)
+		return false
+	}
+
+	return true
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -71,6 +113,12 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
+		{"1.5 <= 1.5", true},
+		{"1 >= 1.5", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -85,6 +133,11 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1.0 == 1", true},
+		{"1 != 1.0", false},
+		{"0.1 + 0.2 == 0.3", false},
 	}
 
 	for _, tt := range tests {
@@ -108,6 +161,55 @@ func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	return true
 }
 
+func TestComparisonEvaluationOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let log = []; let f = fn(x) { log = push(log, x); x }; f(1) < f(2); log", "[1, 2]"},
+		{"let log = []; let f = fn(x) { log = push(log, x); x }; f(2) >= f(1); f(3) <= f(4); f(5) > f(6); log", "[2, 1, 3, 4, 5, 6]"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("operands evaluated in wrong order. expected=%s, got=%s", tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || 1", true},
+		{"1 && 0", true},
+		{"false && (1 + true)", false},
+		{"true || (1 + true)", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		{"let x = 0; let f = fn() { x = 1; true }; false && f(); x", 0},
+		{"let x = 0; let f = fn() { x = 1; true }; true || f(); x", 0},
+		{"let x = 0; let f = fn() { x = 1; true }; true && f(); x", 1},
+		{"if (1 > 2 || 2 > 1) { 10 } else { 20 }", 10},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		}
+	}
+}
+
 func TestBangOperator(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -160,6 +262,142 @@ func testNullObject(t *testing.T, obj object.Object) bool {
 	return true
 }
 
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"while (true) { break; }; 1", 1},
+		{"while (false) { 1 / 0 }; 2", 2},
+		{"let f = fn() { while (true) { return 5; } }; f()", 5},
+		{"for (x in [1, 2, 3]) { }; x", 3},
+		{"for (x in [1, 2, 3]) { if (x == 2) { break; } }; x", 2},
+		{"let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } }; -1 }; f([1, 5, 2])", 5},
+		{"let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } }; -1 }; f([1, 2])", -1},
+		{"let f = fn() { for (x in [1, 2, 3, 4]) { if (x < 3) { continue; } return x; } }; f()", 3},
+		{
+			`let f = fn() {
+				for (x in [1, 2, 3]) {
+					for (y in [10, 20]) {
+						if (y > 10) { break; }
+						if (x < 3) { continue; }
+						return x * y;
+					}
+				}
+			};
+			f()`,
+			30,
+		},
+		{`for (k in {"b": 1, "a": 2, "c": 3}) { break; }; k`, "a"},
+		{`for (c in "hé") { }; c`, "é"},
+		{"for (x in []) { }; 7", 7},
+		{"let f = fn() { for (x in [1]) { x } }; f()", nil},
+		{"if (true) { let y = 1; }", nil},
+		{"if (true) { }", nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("String has wrong value. want=%q, got=%q", expected, str.Value)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let x = 1; let f = fn() { x = 5 }; f(); x", 5},
+		{"let f = fn(n) { n = n * 2; n }; f(4)", 8},
+		{"let f = fn() { let x = 1; let g = fn() { x = x + 10 }; g(); x }; f()", 11},
+		{"let counter = fn() { let c = 0; fn() { c = c + 1; c } }; let next = counter(); next(); next(); next()", 3},
+		{"let mk = fn() { let c = 0; fn() { c = c + 1 } }; let a = mk(); let b = mk(); a(); a(); b()", 1},
+		{"let f = fn() { let x = 0; let g = fn() { let h = fn() { x = x + 1 }; h(); h() }; g(); x }; f()", 2},
+		{"let f = fn() { let g = fn() { g = 5; 1 }; g(); g }; f()", 5},
+		{"let arr = [1, 2, 3]; arr[1] = 20; arr[1]", 20},
+		{"let arr = [1, 2, 3]; let alias = arr; alias[0] = 9; arr[0]", 9},
+		{`let h = {"a": 1}; h["b"] = 2; h["a"] + h["b"]`, 3},
+		{"let h = {}; h[1] = 2", 2},
+		{"let i = 0; let sum = 0; while (i < 5) { sum = sum + i; i = i + 1 }; sum", 10},
+		{"let f = fn() { let i = 0; while (i < 3) { i = i + 1 }; i }; f()", 3},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { 1 / 0 } catch (e) { 2 }", 2},
+		{"try { throw \"x\"; 1 } catch { 2 }", 2},
+		{"let x = 0; try { x = 1 } finally { x = x + 10 }; x", 11},
+		{"let x = 0; try { try { 1 / 0 } finally { x = 5 } } catch (e) { x + 1 }", 6},
+		{"let f = fn() { try { return 1 } finally { 2 } }; f()", 1},
+		{"let f = fn() { try { return 1 } finally { return 2 } }; f()", 2},
+		{"let g = fn() { throw \"deep\" }; let f = fn() { g() + 1 }; try { f() } catch (e) { 7 }", 7},
+		{"let n = 0; for (i in [1, 2, 3]) { try { if (i == 2) { break } } finally { n = n + 1 } }; n", 2},
+		{"let e = try { [] + 1 } catch (err) { err }; try { throw e } catch (again) { len(again[\"message\"]) }", 30},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`1 + true`, object.TYPE_ERROR},
+		{`foo`, object.NAME_ERROR},
+		{`let a = [1]; a[5] = 1`, object.INDEX_ERROR},
+		{`10 % 0`, object.ZERO_DIVISION_ERROR},
+		{`len(1, 2)`, object.ARGUMENT_ERROR},
+		{`fn(a) { a }()`, object.ARGUMENT_ERROR},
+		{`throw "custom"`, object.USER_ERROR},
+		{`throw 1`, object.TYPE_ERROR},
+		{`import "math"`, object.IMPORT_ERROR},
+		{`let [a] = 1`, object.PATTERN_ERROR},
+	}
+
+	for _, tt := range tests {
+		input := "try { " + tt.input + " } catch (e) { e[\"type\"] }"
+
+		str, ok := testEval(input).(*object.String)
+		if !ok {
+			t.Errorf("no string returned for %q", input)
+			continue
+		}
+		if str.Value != tt.expected {
+			t.Errorf("wrong error type for %q. expected=%q, got=%q", tt.input, tt.expected, str.Value)
+		}
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -246,6 +484,10 @@ func TestErrorHandling(t *testing.T) {
 			"foobar",
 			"identifier not found: foobar",
 		},
+		{
+			`import "math"`,
+			"import is not available: no module loader",
+		},
 		{
 			`"Hello" - "World"`,
 			"unknown operator: STRING - STRING",
@@ -254,16 +496,61 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }]`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"for (x in 5) { x }",
+			"cannot iterate over INTEGER",
+		},
+		{
+			"for (x in [1, 2]) { x + true }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"while (1 + true) { }",
+			"type mismatch: INTEGER + BOOLEAN",
+		},
+		{
+			"y = 1",
+			"identifier not found: y",
+		},
+		{
+			"1 / 0",
+			"division by zero",
+		},
+		{
+			"5 % (2 - 2)",
+			"division by zero",
+		},
+		{
+			"len = 1",
+			"cannot assign to builtin len",
+		},
+		{
+			"let a = [1]; a[1] = 2",
+			"index out of range: 1",
+		},
+		{
+			`let a = [1]; a["x"] = 2`,
+			"array index must be INTEGER, got STRING",
+		},
+		{
+			`let s = "ab"; s[0] = "c"`,
+			"index assignment not supported: STRING",
+		},
+		{
+			"let h = {}; h[fn(x) { x }] = 1",
+			"unusable as hash key: FUNCTION",
+		},
 	}
 
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
 
-		errObj, ok := evaluated.(*object.Error)
+		ex, ok := evaluated.(*object.Exception)
 		if !ok {
-			t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+			t.Errorf("no exception returned. got=%T(%+v)", evaluated, evaluated)
 			continue
 		}
+		errObj := ex.Error
 
 		if errObj.Message != tt.expectedMessage {
 			t.Errorf("wrong error message. expected=%q, got=%q", tt.expectedMessage, errObj.Message)
@@ -287,6 +574,61 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestLetPatterns(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let [a, b] = [1, 2]; a * 10 + b`, 12},
+		{`let [first, ...rest] = [1, 2, 3]; rest`, []int{2, 3}},
+		{`let [a, [b, c]] = [1, [2, 3]]; [c, b, a]`, []int{3, 2, 1}},
+		{`let a = 1; let b = 2; let [a, b] = [b, a]; [a, b]`, []int{2, 1}},
+		{`let {x, y} = {"x": 1, "y": 2, "z": 3}; [x, y]`, []int{1, 2}},
+		{`let {point: {x: px}, tags: [t, ...ts]} = {"point": {"x": 5}, "tags": [1, 2]}; [px, t, len(ts)]`, []int{5, 1, 1}},
+		{`let f = fn(pair) { let [a, b] = pair; a - b }; f([5, 2])`, 3},
+		{`let [a, b] = [1]`, "wrong number of elements to destructure: want=2, got=1"},
+		{`let [a, ...b] = []`, "wrong number of elements to destructure: want=at least 1, got=0"},
+		{`let [a] = "a"`, "cannot destructure STRING with an array pattern"},
+		{`let {a} = [1]`, "cannot destructure ARRAY with a hash pattern"},
+		{`let {a, b} = {"a": 1}`, `cannot destructure missing key "b"`},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			ex, ok := evaluated.(*object.Exception)
+			if !ok {
+				t.Errorf("Object is not Exception. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			errObj := ex.Error
+
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Errorf("object not Array. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+
+			if len(array.Elements) != len(expected) {
+				t.Errorf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+				continue
+			}
+
+			for i, expectedEl := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedEl))
+			}
+		}
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
@@ -326,6 +668,65 @@ func TestFunctionApplication(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let f = fn(a, b = 2) { a + b }; f(1)`, 3},
+		{`let f = fn(a, b = 2) { a + b }; f(1, 5)`, 6},
+		{`let f = fn(a, b = a * 10, c = a + b) { [a, b, c] }; f(1)`, []int{1, 10, 11}},
+		{`let f = fn(a, b = a * 10, c = a + b) { [a, b, c] }; f(1, 2)`, []int{1, 2, 3}},
+		{`let f = fn(a = []) { push(a, 1) }; f(); f()`, []int{1}},
+		{`let n = 0; let f = fn(a = n) { a }; n = 5; f()`, 5},
+		{`let f = fn(...rest) { rest }; f()`, []int{}},
+		{`let f = fn(a, ...rest) { rest }; f(1, 2, 3)`, []int{2, 3}},
+		{`let f = fn(a, b = 2, ...rest) { [a, b, len(rest)] }; f(1, 5, 6, 7)`, []int{1, 5, 2}},
+		{`let counter = fn(start = 0) { fn() { start = start + 1 } }; let c = counter(); c(); c()`, 2},
+		{`let f = fn(a, g = fn() { a }) { a = a + 1; g() }; f(1)`, 2},
+		{`fn() { 1 }(1)`, "wrong number of arguments to anonymous function: want=0, got=1"},
+		{`let add = fn(a, b) { a + b }; add(1, 2, 3)`, "wrong number of arguments to add: want=2, got=3"},
+		{`let f = fn(a, b = 2, c = 3) { a }; f()`, "wrong number of arguments to f: want=1 to 3, got=0"},
+		{`let f = fn(a, b, ...rest) { a }; f(1)`, "wrong number of arguments to f: want=at least 2, got=1"},
+		{`let f = fn(a = 1 / 0) { a }; f()`, "division by zero"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			ex, ok := evaluated.(*object.Exception)
+			if !ok {
+				t.Errorf("Object is not Exception. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			errObj := ex.Error
+
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		case []int:
+			array, ok := evaluated.(*object.Array)
+			if !ok {
+				t.Errorf("object not Array. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+
+			if len(array.Elements) != len(expected) {
+				t.Errorf("wrong num of elements. want=%d, got=%d", len(expected), len(array.Elements))
+				continue
+			}
+
+			for i, expectedEl := range expected {
+				testIntegerObject(t, array.Elements[i], int64(expectedEl))
+			}
+		}
+	}
+}
+
 func TestClosures(t *testing.T) {
 	input := `
 	let newAdder = fn(x) {
@@ -374,6 +775,9 @@ func TestBuiltinFunctions(t *testing.T) {
 	}{
 		{`len("")`, 0},
 		{`len("four")`, 4},
+		{`len("a\tb\"")`, 4},
+		{`len("héllo wörld")`, 11},
+		{`len("日本語")`, 3},
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
@@ -395,6 +799,10 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`rest([])`, nil},
 		{`push([], 1)`, []int{1}},
 		{`push(1, 1)`, "argument to `push` must be ARRAY, got INTEGER"},
+		{`arity(fn(a, b = 1) { a })["min"]`, 1},
+		{`arity(fn(a, b = 1) { a })["max"]`, 2},
+		{`arity(fn(...rest) { rest })["max"]`, -1},
+		{`arity(len)`, "argument to `arity` must be a user defined function, got BUILTIN"},
 	}
 
 	for _, tt := range tests {
@@ -406,11 +814,12 @@ func TestBuiltinFunctions(t *testing.T) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
 		case string:
-			errObj, ok := evaluated.(*object.Error)
+			ex, ok := evaluated.(*object.Exception)
 			if !ok {
-				t.Errorf("Object is not Error. got=%T (%+v)", evaluated, evaluated)
+				t.Errorf("Object is not Exception. got=%T (%+v)", evaluated, evaluated)
 				continue
 			}
+			errObj := ex.Error
 
 			if errObj.Message != expected {
 				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
@@ -511,6 +920,47 @@ func TestArrayIndexExpressions(t *testing.T) {
 	}
 }
 
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"monkey"[0]`, "m"},
+		{`"monkey"[5]`, "y"},
+		{`"héllo"[1]`, "é"},
+		{`"héllo"[2]`, "l"},
+		{`"日本語"[2]`, "語"},
+		{`"monkey"[6]`, nil},
+		{`"monkey"[-1]`, nil},
+		{`""[0]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		str, ok := tt.expected.(string)
+		if !ok {
+			testNullObject(t, evaluated)
+			continue
+		}
+
+		result, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if result.Value != str {
+			t.Errorf("String has wrong value. want=%q, got=%q", str, result.Value)
+		}
+	}
+}
+
+func TestUnicodeIdentifiers(t *testing.T) {
+	input := `let größe = 3; let 数 = 4; let x2 = größe * 数; x2`
+
+	testIntegerObject(t, testEval(input), 12)
+}
+
 func TestHashLiterals(t *testing.T) {
 	input := `
 		let two = "two";
@@ -598,3 +1048,33 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedPos string
+	}{
+		{"5 + true;", "1:3"},
+		{"let x = 1;\nfoobar", "2:1"},
+		{"let f = fn(x) {\n  -x\n};\nf(true)", "2:3"},
+		{`{"name": "Monkey"}[fn(x) { x }]`, "1:19"},
+		{"let f = fn(a) { a };\nf(1, 2)", "2:2"},
+		{"let f = fn(a = 1 / 0) { a };\nf()", "1:18"},
+		{"let [a, [b]] =\n  [1, 2]", "1:9"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		ex, ok := evaluated.(*object.Exception)
+		if !ok {
+			t.Errorf("no exception returned. got=%T(%+v)", evaluated, evaluated)
+			continue
+		}
+		errObj := ex.Error
+
+		if errObj.Pos.String() != tt.expectedPos {
+			t.Errorf("wrong error position. expected=%q, got=%q", tt.expectedPos, errObj.Pos)
+		}
+	}
+}
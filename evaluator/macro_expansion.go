@@ -1,6 +1,7 @@
 package evaluator
 
 import (
+	"fmt"
 	"monkey/ast"
 	"monkey/object"
 )
@@ -26,7 +27,7 @@ func DefineMacros(program *ast.Program, env *object.Environment) {
 
 func isMacroDefinition(node ast.Statement) bool {
 	letStatement, ok := node.(*ast.LetStatement)
-	if !ok {
+	if !ok || letStatement.Name == nil {
 		return false
 	}
 
@@ -51,10 +52,24 @@ func addMacro(stmt ast.Statement, env *object.Environment) {
 	env.Set(letStatement.Name.Value, macro)
 }
 
+// ExpandMacros : replace every macro call in program with the AST node returned by the macro. Panics when a macro
+// cannot be expanded, see TryExpandMacros
 func ExpandMacros(program ast.Node, env *object.Environment) ast.Node {
-	return ast.Modify(program, func(node ast.Node) ast.Node {
+	expanded, err := TryExpandMacros(program, env)
+	if err != nil {
+		panic(err.Error())
+	}
+	return expanded
+}
+
+// TryExpandMacros : like ExpandMacros, but reports macros called with the wrong number of arguments or not returning
+// a quoted AST node as an error
+func TryExpandMacros(program ast.Node, env *object.Environment) (ast.Node, error) {
+	var err error
+
+	expanded := ast.Modify(program, func(node ast.Node) ast.Node {
 		callExpression, ok := node.(*ast.CallExpression)
-		if !ok {
+		if !ok || err != nil {
 			return node
 		}
 
@@ -63,6 +78,13 @@ func ExpandMacros(program ast.Node, env *object.Environment) ast.Node {
 			return node
 		}
 
+		name := callExpression.Function.String()
+		if len(callExpression.Arguments) != len(macro.Parameters) {
+			err = fmt.Errorf("%s: wrong number of arguments to macro %s: want=%d, got=%d",
+				callExpression.Pos(), name, len(macro.Parameters), len(callExpression.Arguments))
+			return node
+		}
+
 		args := quoteArgs(callExpression)
 		evalEnv := extendMacroEnv(macro, args)
 
@@ -70,11 +92,26 @@ func ExpandMacros(program ast.Node, env *object.Environment) ast.Node {
 
 		quote, ok := evaluated.(*object.Quote)
 		if !ok {
-			panic("we only support returning AST-nodes from macros")
+			err = fmt.Errorf("%s: macro %s must return a quoted AST node, got %s",
+				callExpression.Pos(), name, describeMacroResult(evaluated))
+			return node
 		}
 
 		return quote.Node
 	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return expanded, nil
+}
+
+func describeMacroResult(obj object.Object) string {
+	if obj == nil {
+		return "nothing"
+	}
+	return obj.Inspect()
 }
 
 func isMacroCall(exp *ast.CallExpression, env *object.Environment) (*object.Macro, bool) {
@@ -0,0 +1,66 @@
+package evaluator
+
+import (
+	"monkey/ast"
+	"monkey/module"
+	"monkey/object"
+	"monkey/token"
+)
+
+// NewImporter : return an importer running the modules found by loader, each in its own environment. Set it on the
+// environment of a program with Environment.SetImporter to enable import expressions
+func NewImporter(loader *module.Loader) object.Importer {
+	var importer object.Importer
+
+	run := func(filename string, program *ast.Program) (object.Object, error) {
+		env := object.NewEnvironment()
+		env.SetImporter(importer)
+		return evalModule(program, env)
+	}
+
+	importer = func(path string, pos token.Position) object.Object {
+		namespace, err := loader.Load(path, pos.Filename, run)
+		if errObj, ok := err.(*object.Error); ok {
+			// errors thrown by the module keep their kind and position in the module
+			return &object.Exception{Error: errObj}
+		}
+		if err != nil {
+			return newError(object.IMPORT_ERROR, "%s", err)
+		}
+		return namespace
+	}
+
+	return importer
+}
+
+func evalImportExpression(node *ast.ImportExpression, env *object.Environment) object.Object {
+	importer := env.Importer()
+	if importer == nil {
+		return withPosition(newError(object.IMPORT_ERROR, "import is not available: no module loader"), node)
+	}
+
+	return withPosition(importer(node.Path, node.Pos()), node)
+}
+
+// evalModule : expand the macros of a module and run it, returning the hash of its exported bindings
+func evalModule(program *ast.Program, env *object.Environment) (object.Object, error) {
+	macroEnv := object.NewEnvironment()
+	DefineMacros(program, macroEnv)
+
+	expanded, err := TryExpandMacros(program, macroEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	result := Eval(expanded, env)
+	if ex, ok := result.(*object.Exception); ok {
+		return nil, ex.Error
+	}
+
+	exports := make(map[string]object.Object)
+	for _, name := range module.Exports(program) {
+		exports[name], _ = env.Get(name)
+	}
+
+	return module.Namespace(exports), nil
+}
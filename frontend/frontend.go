@@ -0,0 +1,33 @@
+// package frontend
+// stage shared by the evaluator and the compiler: defines the macros of a parsed program and expands their calls, so
+// both engines run the same macro-free program
+
+package frontend
+
+import (
+	"monkey/ast"
+	"monkey/evaluator"
+	"monkey/object"
+)
+
+// Frontend : keeps the macros defined by every program it processed, so a REPL session can use macros defined in
+// earlier inputs
+type Frontend struct {
+	macroEnv *object.Environment
+}
+
+func New() *Frontend {
+	return &Frontend{macroEnv: object.NewEnvironment()}
+}
+
+// Process : remove the macro definitions from program and expand every macro call in it
+func (f *Frontend) Process(program *ast.Program) (*ast.Program, error) {
+	evaluator.DefineMacros(program, f.macroEnv)
+
+	expanded, err := evaluator.TryExpandMacros(program, f.macroEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	return expanded.(*ast.Program), nil
+}
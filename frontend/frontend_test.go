@@ -0,0 +1,77 @@
+package frontend
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"strings"
+	"testing"
+)
+
+func TestProcess(t *testing.T) {
+	f := New()
+
+	program := parse(t, `
+		let unless = macro(cond, cons, alt) { quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) }) };
+		unless(10 > 5, puts("not greater"), puts("greater"));
+	`)
+
+	expanded, err := f.Process(program)
+	if err != nil {
+		t.Fatalf("Process failed: %s", err)
+	}
+
+	expected := `if(!(10 > 5)) puts(not greater)else puts(greater)`
+	if expanded.String() != expected {
+		t.Errorf("wrong expansion. want=%q, got=%q", expected, expanded.String())
+	}
+
+	// macros stay defined for the programs processed later
+	expanded, err = f.Process(parse(t, `unless(true, 1, 2)`))
+	if err != nil {
+		t.Fatalf("Process failed: %s", err)
+	}
+
+	expected = `if(!true) 1else 2`
+	if expanded.String() != expected {
+		t.Errorf("wrong expansion. want=%q, got=%q", expected, expanded.String())
+	}
+}
+
+func TestProcessErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{
+			"let m = macro(a) { 1 };\nm(2);",
+			"2:2: macro m must return a quoted AST node, got 1",
+		},
+		{
+			"let m = macro(a, b) { quote(a) };\nm(2);",
+			"2:2: wrong number of arguments to macro m: want=2, got=1",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := New().Process(parse(t, tt.input))
+		if err == nil {
+			t.Errorf("expected error for %q", tt.input)
+			continue
+		}
+
+		if !strings.HasSuffix(err.Error(), tt.expectedMessage) {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expectedMessage, err.Error())
+		}
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
@@ -3,31 +3,77 @@
 
 package lexer
 
-import "monkey/token"
+import (
+	"fmt"
+	"monkey/token"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
 
-// Lexer : lexer struct definition
+// messages carried by the ILLEGAL tokens produced for malformed input
+const (
+	UnterminatedComment = "unterminated block comment"
+	UnterminatedString  = "unterminated string"
+	InvalidUTF8         = "invalid UTF-8 encoding"
+)
+
+// Lexer : lexer struct definition. The input is scanned as UTF-8, one character (rune) at a time: position and
+// readPosition are byte offsets, columns count characters
 type Lexer struct {
 	input        string
 	position     int
 	readPosition int
-	ch           byte
+	ch           rune
+
+	filename string
+	line     int
+	column   int
 }
 
 // New : create and return new lexer with a certain input
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFile(input, "")
+}
+
+// NewWithFile : create and return new lexer whose token positions refer to the given file name
+func NewWithFile(input string, filename string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+
+	width := 1
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
-		l.ch = l.input[l.readPosition]
+		l.ch, width = utf8.DecodeRuneInString(l.input[l.readPosition:])
 	}
 	l.position = l.readPosition
-	l.readPosition++
+	l.readPosition += width
+	l.column++
+}
+
+// invalidChar : report whether the current character is a byte that is not valid UTF-8
+func (l *Lexer) invalidChar() bool {
+	return l.ch == utf8.RuneError && l.readPosition-l.position == 1
+}
+
+// currentPosition : source position of the character being examined
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
 }
 
 // NextToken : returns read token and reads the next one
@@ -36,6 +82,8 @@ func (l *Lexer) NextToken() token.Token {
 
 	l.skipWhitespace()
 
+	pos := l.currentPosition()
+
 	switch l.ch {
 	case '=':
 		if l.peekChar() == '=' {
@@ -52,7 +100,17 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.MINUS, l.ch)
 	case '*':
 		tok = newToken(token.ASTERISK, l.ch)
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '/':
+		if l.peekChar() == '*' {
+			// skipWhitespace only stops at the start of a block comment if it is never closed
+			for l.ch != 0 {
+				l.readChar()
+			}
+			tok = token.Token{Type: token.ILLEGAL, Literal: UnterminatedComment, Pos: pos}
+			return tok
+		}
 		tok = newToken(token.SLASH, l.ch)
 	case '!':
 		if l.peekChar() == '=' {
@@ -63,10 +121,34 @@ func (l *Lexer) NextToken() token.Token {
 		} else {
 			tok = newToken(token.BANG, l.ch)
 		}
+	case '&':
+		if l.peekChar() == '&' {
+			l.readChar()
+			tok = token.Token{Type: token.AND, Literal: "&&"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			l.readChar()
+			tok = token.Token{Type: token.OR, Literal: "||"}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.LT_EQ, Literal: "<="}
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			l.readChar()
+			tok = token.Token{Type: token.GT_EQ, Literal: ">="}
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
@@ -81,13 +163,28 @@ func (l *Lexer) NextToken() token.Token {
 		tok = newToken(token.COLON, l.ch)
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
+	case '.':
+		if l.peekChar() == '.' && l.peekCharAt(1) == '.' {
+			l.readChar()
+			l.readChar()
+			tok = token.Token{Type: token.ELLIPSIS, Literal: "..."}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
 		tok = newToken(token.RBRACKET, l.ch)
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		literal, errMsg := l.readString()
+		if errMsg == UnterminatedString {
+			return token.Token{Type: token.ILLEGAL, Literal: errMsg, Pos: pos}
+		}
+		if errMsg != "" {
+			tok = token.Token{Type: token.ILLEGAL, Literal: errMsg}
+		} else {
+			tok = token.Token{Type: token.STRING, Literal: literal}
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -95,68 +192,201 @@ func (l *Lexer) NextToken() token.Token {
 		if isLetter(l.ch) {
 			tok.Literal = l.readIdentifier()
 			tok.Type = token.LookupIdent(tok.Literal)
+			tok.Pos = pos
 			return tok // early exit here because I already call readChar inside readIdentifier so there's no need to call it again
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Literal, tok.Type = l.readNumber()
+			tok.Pos = pos
 			return tok // early exit here because I already call readChar inside readIdentifier so there's no need to call it again
 		}
-		tok = newToken(token.ILLEGAL, l.ch)
+		if l.invalidChar() {
+			tok = token.Token{Type: token.ILLEGAL, Literal: InvalidUTF8}
+		} else {
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	}
 	l.readChar()
+	tok.Pos = pos
 	return tok
 }
 
-func newToken(tokenType token.TokenType, ch byte) token.Token {
+func newToken(tokenType token.TokenType, ch rune) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
-// readIdentifier : read and return a whole identifier string
+// readIdentifier : read and return a whole identifier string. Identifiers start with a letter and go on with letters
+// and digits
 func (l *Lexer) readIdentifier() string {
 	position := l.position
-	for isLetter(l.ch) {
+	for isLetter(l.ch) || unicode.IsDigit(l.ch) {
 		l.readChar()
 	}
 	return l.input[position:l.position]
 }
 
-// readNumber : read and return a whole number as string
-func (l *Lexer) readNumber() string {
+// readNumber : read and return a whole number as string, together with its type. Numbers with a fractional part
+// (digits on both sides of the dot) or an exponent are floats
+func (l *Lexer) readNumber() (string, token.TokenType) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(l.peekCharAt(1))) {
+			tokenType = token.FLOAT
+			l.readChar()
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return l.input[position:l.position], tokenType
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// readString : read a string literal up to its closing quote, decoding escape sequences. On malformed input the
+// returned message describes the problem: UnterminatedString when the input ends first, otherwise the first invalid
+// escape sequence. The rest of the string is still consumed so lexing resumes after it
+func (l *Lexer) readString() (string, string) {
+	var out strings.Builder
+	errMsg := ""
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+
+		switch l.ch {
+		case 0:
+			return "", UnterminatedString
+		case '"':
+			return out.String(), errMsg
+		case '\\':
+			l.readChar()
+			if l.ch == 0 {
+				return "", UnterminatedString
+			}
+
+			msg := l.readEscape(&out)
+			if errMsg == "" {
+				errMsg = msg
+			}
+		default:
+			// copy the raw input so that even invalid UTF-8 goes through unchanged
+			out.WriteString(l.input[l.position:l.readPosition])
 		}
 	}
-	return l.input[position:l.position]
 }
 
-func isLetter(ch byte) bool {
-	return ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ch == '_'
+// readEscape : decode the escape sequence whose first character (after the backslash) is the current one
+func (l *Lexer) readEscape(out *strings.Builder) string {
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '"':
+		out.WriteByte('"')
+	case '\\':
+		out.WriteByte('\\')
+	case 'u':
+		if l.peekChar() != '{' {
+			return "invalid unicode escape: expected \\u{...}"
+		}
+		l.readChar()
+
+		digits := ""
+		for isHexDigit(l.peekChar()) {
+			l.readChar()
+			digits += string(l.ch)
+		}
+		if l.peekChar() != '}' {
+			return "invalid unicode escape: expected \\u{...}"
+		}
+		l.readChar()
+
+		code, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil || len(digits) > 6 || !utf8.ValidRune(rune(code)) {
+			return fmt.Sprintf("invalid unicode escape \\u{%s}", digits)
+		}
+		out.WriteRune(rune(code))
+	default:
+		return fmt.Sprintf("unknown escape sequence \\%c", l.ch)
+	}
+
+	return ""
+}
+
+func isLetter(ch rune) bool {
+	return unicode.IsLetter(ch) || ch == '_'
 }
 
-func isDigit(ch byte) bool {
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
+}
+
+func isDigit(ch rune) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+// skipWhitespace : skip whitespace, `//` line comments and `/* */` block comments. An unterminated block comment is
+// left in place for NextToken to report
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
-		l.readChar()
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r':
+			l.readChar()
+		case l.ch == '/' && l.peekChar() == '/':
+			for l.ch != '\n' && l.ch != 0 {
+				l.readChar()
+			}
+		case l.ch == '/' && l.peekChar() == '*':
+			if !strings.Contains(l.input[l.readPosition+1:], "*/") {
+				return
+			}
+			l.readChar()
+			l.readChar()
+			for !(l.ch == '*' && l.peekChar() == '/') {
+				l.readChar()
+			}
+			l.readChar()
+			l.readChar()
+		default:
+			return
+		}
 	}
 }
 
-func (l *Lexer) peekChar() byte {
-	if l.readPosition >= len(l.input) {
+func (l *Lexer) peekChar() rune {
+	return l.peekCharAt(0)
+}
+
+// peekCharAt : look n characters past the next one without consuming input
+func (l *Lexer) peekCharAt(n int) rune {
+	pos := l.readPosition
+	for ; n > 0 && pos < len(l.input); n-- {
+		_, width := utf8.DecodeRuneInString(l.input[pos:])
+		pos += width
+	}
+
+	if pos >= len(l.input) {
 		return 0
 	}
-	return l.input[l.readPosition]
+	ch, _ := utf8.DecodeRuneInString(l.input[pos:])
+	return ch
 }
@@ -16,7 +16,7 @@ func TestNextToken(t *testing.T) {
 		};
 
 		let result = add(five, ten);
-		!-/*5;
+		!-/ *5;
 		5 < 10 > 5;
 
 		if (5 < 10) {
@@ -154,3 +154,288 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{"42", []token.Token{{Type: token.INT, Literal: "42"}}},
+		{"3.14", []token.Token{{Type: token.FLOAT, Literal: "3.14"}}},
+		{"1e10", []token.Token{{Type: token.FLOAT, Literal: "1e10"}}},
+		{"2.5E-3", []token.Token{{Type: token.FLOAT, Literal: "2.5E-3"}}},
+		{"6e+2", []token.Token{{Type: token.FLOAT, Literal: "6e+2"}}},
+		{"1.", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.ILLEGAL, Literal: "."}}},
+		{"1e", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.IDENT, Literal: "e"}}},
+		{"1e-", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.IDENT, Literal: "e"}, {Type: token.MINUS, Literal: "-"}}},
+		{"0.5+1", []token.Token{{Type: token.FLOAT, Literal: "0.5"}, {Type: token.PLUS, Literal: "+"}, {Type: token.INT, Literal: "1"}}},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+
+		for i, expected := range append(tt.expected, token.Token{Type: token.EOF}) {
+			tok := l.NextToken()
+
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: token %d wrong. expected=%s %q, got=%s %q",
+					tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// a line comment before any token
+let /* a */ x /* b */ = /* c */ 5 /* d */; // trailing comment
+/* a block comment
+   spanning lines */ x / 2 // slashes still divide
+fn(a, /* b, */ c) { a } /**/
+"// not a comment" "/* nor this */"
+// a comment ending the input`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{token.LET, "let", 2},
+		{token.IDENT, "x", 2},
+		{token.ASSIGN, "=", 2},
+		{token.INT, "5", 2},
+		{token.SEMICOLON, ";", 2},
+		{token.IDENT, "x", 4},
+		{token.SLASH, "/", 4},
+		{token.INT, "2", 4},
+		{token.FUNCTION, "fn", 5},
+		{token.LPAREN, "(", 5},
+		{token.IDENT, "a", 5},
+		{token.COMMA, ",", 5},
+		{token.IDENT, "c", 5},
+		{token.RPAREN, ")", 5},
+		{token.LBRACE, "{", 5},
+		{token.IDENT, "a", 5},
+		{token.RBRACE, "}", 5},
+		{token.STRING, "// not a comment", 6},
+		{token.STRING, "/* nor this */", 6},
+		{token.EOF, "", 7},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - wrong token. expected=%s %q, got=%s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+
+		if tok.Pos.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - wrong line. expected=%d, got=%d", i, tt.expectedLine, tok.Pos.Line)
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+	input := `a && b || !c & d | e
+a <= b >= c < d > e % f
+...rest .. .`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.BANG, "!"},
+		{token.IDENT, "c"},
+		{token.ILLEGAL, "&"},
+		{token.IDENT, "d"},
+		{token.ILLEGAL, "|"},
+		{token.IDENT, "e"},
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.LT, "<"},
+		{token.IDENT, "d"},
+		{token.GT, ">"},
+		{token.IDENT, "e"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "f"},
+		{token.ELLIPSIS, "..."},
+		{token.IDENT, "rest"},
+		{token.ILLEGAL, "."},
+		{token.ILLEGAL, "."},
+		{token.ILLEGAL, "."},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - wrong token. expected=%s %q, got=%s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	tests := []string{
+		"let x = 1; /* never closed",
+		"let x = 1; /*/",
+		"let x = 1; /* almost closed *",
+	}
+
+	for _, input := range tests {
+		l := New(input)
+
+		var tok token.Token
+		for tok = l.NextToken(); tok.Type != token.ILLEGAL && tok.Type != token.EOF; tok = l.NextToken() {
+		}
+
+		if tok.Type != token.ILLEGAL || tok.Literal != UnterminatedComment {
+			t.Errorf("%q: expected ILLEGAL %q, got %s %q", input, UnterminatedComment, tok.Type, tok.Literal)
+			continue
+		}
+		if tok.Pos.Column != 12 {
+			t.Errorf("%q: wrong column. expected=12, got=%d", input, tok.Pos.Column)
+		}
+
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("%q: expected EOF after the unterminated comment, got %s", input, next.Type)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{`"plain"`, token.STRING, "plain"},
+		{`"line\nbreak"`, token.STRING, "line\nbreak"},
+		{`"tab\there"`, token.STRING, "tab\there"},
+		{`"say \"hi\""`, token.STRING, `say "hi"`},
+		{`"back\\slash"`, token.STRING, `back\slash`},
+		{`"\u{48}\u{49}"`, token.STRING, "HI"},
+		{`"\u{1F600}"`, token.STRING, "\U0001F600"},
+		{`"bad \q escape"`, token.ILLEGAL, `unknown escape sequence \q`},
+		{`"\u{110000}"`, token.ILLEGAL, `invalid unicode escape \u{110000}`},
+		{`"\u{}"`, token.ILLEGAL, `invalid unicode escape \u{}`},
+		{`"\u48"`, token.ILLEGAL, `invalid unicode escape: expected \u{...}`},
+		{`"never closed`, token.ILLEGAL, UnterminatedString},
+		{`"escaped quote at the end\"`, token.ILLEGAL, UnterminatedString},
+		{`"trailing backslash\`, token.ILLEGAL, UnterminatedString},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Errorf("%s: wrong token. expected=%s %q, got=%s %q",
+				tt.input, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+		if tok.Pos.Column != 1 {
+			t.Errorf("%s: wrong column. expected=1, got=%d", tt.input, tok.Pos.Column)
+		}
+
+		if next := l.NextToken(); next.Type != token.EOF {
+			t.Errorf("%s: expected EOF after the string, got %s %q", tt.input, next.Type, next.Literal)
+		}
+	}
+}
+
+func TestUnicode(t *testing.T) {
+	input := "let größe = \"日本語\";\nπ2 + größe; \xff"
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+		expectedLine    int
+		expectedColumn  int
+	}{
+		{token.LET, "let", 1, 1},
+		{token.IDENT, "größe", 1, 5},
+		{token.ASSIGN, "=", 1, 11},
+		{token.STRING, "日本語", 1, 13},
+		{token.SEMICOLON, ";", 1, 18},
+		{token.IDENT, "π2", 2, 1},
+		{token.PLUS, "+", 2, 4},
+		{token.IDENT, "größe", 2, 6},
+		{token.SEMICOLON, ";", 2, 11},
+		{token.ILLEGAL, InvalidUTF8, 2, 13},
+		{token.EOF, "", 2, 14},
+	}
+
+	l := New(input)
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - wrong token. expected=%s %q, got=%s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+
+		if tok.Pos.Line != tt.expectedLine || tok.Pos.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - wrong position. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Pos.Line, tok.Pos.Column)
+		}
+	}
+}
+
+func TestTokenPositions(t *testing.T) {
+	input := "let x = 5;\n  x + 10\n\"str\""
+
+	tests := []struct {
+		expectedType   token.TokenType
+		expectedLine   int
+		expectedColumn int
+		expectedOffset int
+	}{
+		{token.LET, 1, 1, 0},
+		{token.IDENT, 1, 5, 4},
+		{token.ASSIGN, 1, 7, 6},
+		{token.INT, 1, 9, 8},
+		{token.SEMICOLON, 1, 10, 9},
+		{token.IDENT, 2, 3, 13},
+		{token.PLUS, 2, 5, 15},
+		{token.INT, 2, 7, 17},
+		{token.STRING, 3, 1, 20},
+		{token.EOF, 3, 6, 25},
+	}
+
+	l := NewWithFile(input, "test.mk")
+
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Pos.Filename != "test.mk" {
+			t.Fatalf("tests[%d] - filename wrong. expected=%q, got=%q", i, "test.mk", tok.Pos.Filename)
+		}
+
+		if tok.Pos.Line != tt.expectedLine || tok.Pos.Column != tt.expectedColumn {
+			t.Fatalf("tests[%d] - position wrong. expected=%d:%d, got=%d:%d",
+				i, tt.expectedLine, tt.expectedColumn, tok.Pos.Line, tok.Pos.Column)
+		}
+
+		if tok.Pos.Offset != tt.expectedOffset {
+			t.Fatalf("tests[%d] - offset wrong. expected=%d, got=%d", i, tt.expectedOffset, tok.Pos.Offset)
+		}
+	}
+}
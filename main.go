@@ -3,14 +3,29 @@ package main
 import (
 	"flag"
 	"fmt"
+	"monkey/module"
 	"monkey/repl"
 	"os"
 	"os/user"
+	"path/filepath"
 )
 
 var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "run":
+			os.Exit(runCommand(os.Args[2:]))
+		case "build":
+			os.Exit(buildCommand(os.Args[2:]))
+		case "exec":
+			os.Exit(execCommand(os.Args[2:]))
+		case "disasm":
+			os.Exit(disasmCommand(os.Args[2:]))
+		}
+	}
+
 	flag.Parse()
 
 	user, err := user.Current()
@@ -28,3 +43,33 @@ func main() {
 		fmt.Printf("Please specify a valid evaluation engine")
 	}
 }
+
+// pathFlag : define the flag of the search path of imported modules, defaulting to the MONKEYPATH environment variable
+func pathFlag(fs *flag.FlagSet) *string {
+	usage := fmt.Sprintf("directories searched for imported modules, separated by %q", filepath.ListSeparator)
+	return fs.String("path", os.Getenv(module.PathEnv), usage)
+}
+
+// optimizeFlag : define the flag enabling the optimizer of the compiler, on by default
+func optimizeFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("optimize", true, "fold constant expressions and prune dead branches before compiling")
+}
+
+// parseCommandArgs : parse flags for a subcommand, allowing them both before and after positional arguments
+func parseCommandArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
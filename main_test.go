@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRunExitStatus : only an error left uncaught makes `monkey run` fail, on both engines. A caught error is an
+// ordinary value, even as the value of the last statement of the program or of an imported module
+func TestRunExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected int
+	}{
+		{"caught", map[string]string{"main.mk": `try { throw "x" } catch (e) { e }`}, 0},
+		{"uncaught", map[string]string{"main.mk": `throw "x"`}, 1},
+		{
+			"module caught",
+			map[string]string{
+				"main.mk": `let m = import "errors"; m["e"]["message"]`,
+				"errors.mk": `export let e = try { throw "x" } catch (err) { err };
+					e`,
+			},
+			0,
+		},
+		{
+			"module uncaught",
+			map[string]string{"main.mk": `import "errors"`, "errors.mk": `throw "x"`},
+			1,
+		},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "monkey-run")
+		if err != nil {
+			t.Fatalf("TempDir failed: %s", err)
+		}
+		defer os.RemoveAll(dir)
+
+		for name, content := range tt.files {
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+			if err != nil {
+				t.Fatalf("WriteFile failed: %s", err)
+			}
+		}
+
+		for _, engine := range []string{"vm", "eval"} {
+			status := runCommand([]string{filepath.Join(dir, "main.mk"), "--engine", engine, "--path", dir})
+			if status != tt.expected {
+				t.Errorf("%s, engine=%s: wrong exit status. expected=%d, got=%d", tt.name, engine, tt.expected, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// package module
+// resolves, parses and caches the Monkey source files loaded by import expressions
+
+package module
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SourceExt : extension of Monkey source files, added to import paths that have none
+const SourceExt = ".mk"
+
+// PathEnv : environment variable holding the default search path, a list of directories separated like PATH
+const PathEnv = "MONKEYPATH"
+
+// RunFunc : run the program of the module read from filename, returning the value imports of the module evaluate to
+type RunFunc func(filename string, program *ast.Program) (object.Object, error)
+
+// Loader : loads the modules imported by a program. Each module is run once, later imports of the same file get the
+// cached result. Import paths are looked up relative to the importing file first, then in each SearchPath directory
+type Loader struct {
+	SearchPath []string
+
+	modules map[string]object.Object // results of the modules already run, by absolute file name
+	loading []string                 // absolute file names of the modules being run, outermost first
+}
+
+// NewLoader : return a loader looking up modules in the given directories
+func NewLoader(searchPath []string) *Loader {
+	return &Loader{
+		SearchPath: searchPath,
+		modules:    make(map[string]object.Object),
+	}
+}
+
+// DefaultSearchPath : return the directories listed in the MONKEYPATH environment variable
+func DefaultSearchPath() []string {
+	return SplitPath(os.Getenv(PathEnv))
+}
+
+// SplitPath : split a list of directories separated like PATH, ignoring empty entries
+func SplitPath(list string) []string {
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(list) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// Load : return the result of the module imported as path by the file from (empty for programs not read from a
+// file). The first time a module is imported it is read, parsed and handed to run
+func (l *Loader) Load(path, from string, run RunFunc) (object.Object, error) {
+	filename, err := l.Resolve(path, from)
+	if err != nil {
+		return nil, err
+	}
+
+	if result, ok := l.modules[filename]; ok {
+		return result, nil
+	}
+
+	if len(l.loading) == 0 && from != "" {
+		// the program importing the first module is part of the chain too, although it is not loaded by l
+		if abs, err := filepath.Abs(from); err == nil {
+			l.loading = []string{abs}
+			defer func() { l.loading = nil }()
+		}
+	}
+
+	for i, loading := range l.loading {
+		if loading == filename {
+			cycle := append(append([]string{}, l.loading[i:]...), filename)
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	program, err := Parse(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	l.loading = append(l.loading, filename)
+	result, err := run(filename, program)
+	l.loading = l.loading[:len(l.loading)-1]
+
+	if err != nil {
+		return nil, err
+	}
+
+	l.modules[filename] = result
+	return result, nil
+}
+
+// Resolve : return the absolute file name of the module imported as path by the file from
+func (l *Loader) Resolve(path, from string) (string, error) {
+	name := filepath.FromSlash(path)
+	if filepath.Ext(name) == "" {
+		name += SourceExt
+	}
+
+	dirs := []string{}
+	if filepath.IsAbs(name) {
+		dirs = append(dirs, "")
+	} else {
+		dirs = append(dirs, filepath.Dir(from))
+		dirs = append(dirs, l.SearchPath...)
+	}
+
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return filepath.Abs(candidate)
+		}
+	}
+
+	return "", fmt.Errorf("cannot find module %q", path)
+}
+
+// Parse : read and parse a module. The source positions of its nodes carry filename
+func Parse(filename string) (*ast.Program, error) {
+	input, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser.New(lexer.NewWithFile(string(input), filename))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, fmt.Errorf("%s", strings.Join(p.Errors(), "\n"))
+	}
+
+	return program, nil
+}
+
+// Exports : return the names bound by the export let statements of a program, in order
+func Exports(program *ast.Program) []string {
+	names := []string{}
+	for _, stmt := range program.Statements {
+		if let, ok := stmt.(*ast.LetStatement); ok && let.Exported {
+			for _, name := range let.Names() {
+				names = append(names, name.Value)
+			}
+		}
+	}
+	return names
+}
+
+// Namespace : return the hash imports evaluate to, mapping the exported names to their values
+func Namespace(exports map[string]object.Object) *object.Hash {
+	pairs := make(map[object.HashKey]object.HashPair, len(exports))
+	for name, value := range exports {
+		key := &object.String{Value: name}
+		pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+	return &object.Hash{Pairs: pairs}
+}
@@ -0,0 +1,167 @@
+package module
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/object"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeFiles : create the files, given by slash separated names relative to a new temporary directory
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "monkey-module")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %s", err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	return dir
+}
+
+func TestResolve(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.mk":        "",
+		"util.mk":        "",
+		"sub/helper.mk":  "",
+		"lib/math.mk":    "",
+		"lib/util.mk":    "",
+		"lib/data.json":  "",
+		"other/extra.mk": "",
+	})
+	loader := NewLoader([]string{filepath.Join(dir, "lib"), filepath.Join(dir, "other")})
+	from := filepath.Join(dir, "main.mk")
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"util", "util.mk"},
+		{"./util", "util.mk"},
+		{"sub/helper", "sub/helper.mk"},
+		{"math", "lib/math.mk"},
+		{"math.mk", "lib/math.mk"},
+		{"data.json", "lib/data.json"},
+		{"extra", "other/extra.mk"},
+		{filepath.ToSlash(filepath.Join(dir, "other", "extra")), "other/extra.mk"},
+	}
+
+	for _, tt := range tests {
+		filename, err := loader.Resolve(tt.path, from)
+		if err != nil {
+			t.Errorf("Resolve(%q) failed: %s", tt.path, err)
+			continue
+		}
+
+		expected := filepath.Join(dir, filepath.FromSlash(tt.expected))
+		if filename != expected {
+			t.Errorf("Resolve(%q) wrong. expected=%q, got=%q", tt.path, expected, filename)
+		}
+	}
+
+	_, err := loader.Resolve("missing", from)
+	if err == nil || err.Error() != `cannot find module "missing"` {
+		t.Errorf("wrong error for a missing module. got=%v", err)
+	}
+
+	_, err = loader.Resolve("sub", from)
+	if err == nil {
+		t.Errorf("expected an error resolving a directory")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.mk": `let a = import "a";`,
+		"a.mk":    `let b = import "b"; export let x = 1;`,
+		"b.mk":    `export let y = 2;`,
+	})
+	loader := NewLoader(nil)
+
+	runs := []string{}
+	var run RunFunc
+	run = func(filename string, program *ast.Program) (object.Object, error) {
+		runs = append(runs, filepath.Base(filename))
+		if filepath.Base(filename) == "a.mk" {
+			if _, err := loader.Load("b", filename, run); err != nil {
+				return nil, err
+			}
+		}
+		return &object.String{Value: fmt.Sprint(Exports(program))}, nil
+	}
+
+	from := filepath.Join(dir, "main.mk")
+	for i := 0; i < 2; i++ {
+		result, err := loader.Load("a", from, run)
+		if err != nil {
+			t.Fatalf("Load failed: %s", err)
+		}
+		if result.Inspect() != "[x]" {
+			t.Errorf("wrong result. expected=%q, got=%q", "[x]", result.Inspect())
+		}
+	}
+
+	result, err := loader.Load("b", from, run)
+	if err != nil {
+		t.Fatalf("Load failed: %s", err)
+	}
+	if result.Inspect() != "[y]" {
+		t.Errorf("wrong result. expected=%q, got=%q", "[y]", result.Inspect())
+	}
+
+	if !reflect.DeepEqual(runs, []string{"a.mk", "b.mk"}) {
+		t.Errorf("modules not run once each. got=%v", runs)
+	}
+}
+
+func TestLoadCycle(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.mk": `let a = import "a";`,
+		"a.mk":    `let b = import "b";`,
+		"b.mk":    `let main = import "main";`,
+	})
+	loader := NewLoader(nil)
+
+	var run RunFunc
+	run = func(filename string, program *ast.Program) (object.Object, error) {
+		imp := program.Statements[0].(*ast.LetStatement).Value.(*ast.ImportExpression)
+		return loader.Load(imp.Path, filename, run)
+	}
+
+	_, err := loader.Load("a", filepath.Join(dir, "main.mk"), run)
+	if err == nil {
+		t.Fatalf("expected an import cycle error")
+	}
+
+	main, a, b := filepath.Join(dir, "main.mk"), filepath.Join(dir, "a.mk"), filepath.Join(dir, "b.mk")
+	expected := fmt.Sprintf("import cycle: %s -> %s -> %s -> %s", main, a, b, main)
+	if err.Error() != expected {
+		t.Errorf("wrong error. expected=%q, got=%q", expected, err)
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	list := "a" + string(filepath.ListSeparator) + string(filepath.ListSeparator) + "b"
+	if got := SplitPath(list); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("SplitPath wrong. expected=%v, got=%v", []string{"a", "b"}, got)
+	}
+
+	if got := SplitPath(""); len(got) != 0 {
+		t.Errorf("SplitPath of an empty list not empty. got=%v", got)
+	}
+}
@@ -1,6 +1,9 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"unicode/utf8"
+)
 
 var Builtins = []struct {
 	Name    string
@@ -10,16 +13,16 @@ var Builtins = []struct {
 		"len",
 		&Builtin{Fn: func(args ...Object) Object {
 			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1", len(args))
 			}
 
 			switch arg := args[0].(type) {
 			case *Array:
 				return &Integer{Value: int64(len(arg.Elements))}
 			case *String:
-				return &Integer{Value: int64(len(arg.Value))}
+				return &Integer{Value: int64(utf8.RuneCountInString(arg.Value))}
 			default:
-				return newError("argument to `len` not supported, got %s", args[0].Type())
+				return newError(TYPE_ERROR, "argument to `len` not supported, got %s", args[0].Type())
 			}
 		}},
 	},
@@ -37,11 +40,11 @@ var Builtins = []struct {
 		"first",
 		&Builtin{func(args ...Object) Object {
 			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1", len(args))
 			}
 
 			if args[0].Type() != ARRAY_OBJ {
-				return newError("argument to `first` must be ARRAY, got %s", args[0].Type())
+				return newError(TYPE_ERROR, "argument to `first` must be ARRAY, got %s", args[0].Type())
 			}
 
 			arr := args[0].(*Array)
@@ -56,11 +59,11 @@ var Builtins = []struct {
 		"last",
 		&Builtin{func(args ...Object) Object {
 			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1", len(args))
 			}
 
 			if args[0].Type() != ARRAY_OBJ {
-				return newError("argument to `last` must be ARRAY, got %s", args[0].Type())
+				return newError(TYPE_ERROR, "argument to `last` must be ARRAY, got %s", args[0].Type())
 			}
 
 			arr := args[0].(*Array)
@@ -75,11 +78,11 @@ var Builtins = []struct {
 		"rest",
 		&Builtin{func(args ...Object) Object {
 			if len(args) != 1 {
-				return newError("wrong number of arguments. got=%d, want=1", len(args))
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1", len(args))
 			}
 
 			if args[0].Type() != ARRAY_OBJ {
-				return newError("argument to `rest` must be ARRAY, got %s", args[0].Type())
+				return newError(TYPE_ERROR, "argument to `rest` must be ARRAY, got %s", args[0].Type())
 			}
 
 			arr := args[0].(*Array)
@@ -96,11 +99,11 @@ var Builtins = []struct {
 		"push",
 		&Builtin{func(args ...Object) Object {
 			if len(args) != 2 {
-				return newError("wrong number of arguments. got=%d, want=2", len(args))
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=2", len(args))
 			}
 
 			if args[0].Type() != ARRAY_OBJ {
-				return newError("argument to `push` must be ARRAY, got %s", args[0].Type())
+				return newError(TYPE_ERROR, "argument to `push` must be ARRAY, got %s", args[0].Type())
 			}
 
 			arr := args[0].(*Array)
@@ -113,10 +116,40 @@ var Builtins = []struct {
 			return &Array{Elements: newElements}
 		}},
 	},
+	{
+		"arity",
+		&Builtin{func(args ...Object) Object {
+			if len(args) != 1 {
+				return newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1", len(args))
+			}
+
+			var arity Arity
+			switch fn := args[0].(type) {
+			case *Function:
+				arity = fn.Arity()
+			case *Closure:
+				arity = fn.Fn.Arity()
+			default:
+				return newError(TYPE_ERROR, "argument to `arity` must be a user defined function, got %s", args[0].Type())
+			}
+
+			// the maximum is -1 for variadic functions
+			pairs := map[HashKey]HashPair{}
+			for _, field := range []struct {
+				name  string
+				value int
+			}{{"min", arity.Min}, {"max", arity.Max}} {
+				key := &String{Value: field.name}
+				pairs[key.HashKey()] = HashPair{Key: key, Value: &Integer{Value: int64(field.value)}}
+			}
+			return &Hash{Pairs: pairs}
+		}},
+	},
 }
 
-func newError(format string, a ...interface{}) *Error {
-	return &Error{Message: fmt.Sprintf(format, a...)}
+// newError : return an exception raising a new error of the given kind
+func newError(kind, format string, a ...interface{}) *Exception {
+	return &Exception{Error: &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}}
 }
 
 func GetBuiltinByName(name string) *Builtin {
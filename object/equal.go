@@ -0,0 +1,81 @@
+package object
+
+// Equal : value equality used by the == and != operators of both engines. Numbers are equal if they have the same
+// value, whether integers or floats. Strings, booleans and null compare by value, arrays and hashes compare their
+// elements recursively. Any other object is only equal to itself
+func Equal(a, b Object) bool {
+	return equal(a, b, map[visit]bool{})
+}
+
+// visit : a pair of arrays or hashes being compared
+type visit struct {
+	a, b Object
+}
+
+// equal : Equal, the arrays and hashes of visited being already under comparison. Reaching such a pair again means
+// the values contain themselves, and the pair is equal unless another of their elements differs
+func equal(a, b Object, visited map[visit]bool) bool {
+	switch a := a.(type) {
+	case *Integer:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value == b.Value
+		case *Float:
+			return float64(a.Value) == b.Value
+		}
+		return false
+	case *Float:
+		switch b := b.(type) {
+		case *Integer:
+			return a.Value == float64(b.Value)
+		case *Float:
+			return a.Value == b.Value
+		}
+		return false
+	case *String:
+		b, ok := b.(*String)
+		return ok && a.Value == b.Value
+	case *Boolean:
+		b, ok := b.(*Boolean)
+		return ok && a.Value == b.Value
+	case *Null:
+		_, ok := b.(*Null)
+		return ok
+	case *Array:
+		b, ok := b.(*Array)
+		if !ok || len(a.Elements) != len(b.Elements) {
+			return false
+		}
+		// checked for arrays and hashes only, a float NaN being unequal to itself
+		if a == b || visited[visit{a, b}] {
+			return true
+		}
+		visited[visit{a, b}] = true
+
+		for i, el := range a.Elements {
+			if !equal(el, b.Elements[i], visited) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		b, ok := b.(*Hash)
+		if !ok || len(a.Pairs) != len(b.Pairs) {
+			return false
+		}
+		if a == b || visited[visit{a, b}] {
+			return true
+		}
+		visited[visit{a, b}] = true
+
+		for key, pair := range a.Pairs {
+			other, ok := b.Pairs[key]
+			if !ok || !equal(pair.Value, other.Value, visited) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
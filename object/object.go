@@ -7,8 +7,12 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/token"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -17,11 +21,13 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	STRING_OBJ            = "STRING"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
 	ERROR_OBJ             = "ERROR"
+	EXCEPTION_OBJ         = "EXCEPTION"
 	FUNCTION_OBJ          = "FUNCTION"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 	CLOSURE_OBJ           = "CLOSURE"
@@ -30,13 +36,24 @@ const (
 	HASH_OBJ              = "HASH"
 	QUOTE_OBJ             = "QUOTE"
 	MACRO_OBJ             = "MACRO"
+	ITERATOR_OBJ          = "ITERATOR"
+	BREAK_OBJ             = "BREAK"
+	CONTINUE_OBJ          = "CONTINUE"
+	CELL_OBJ              = "CELL"
+	MODULE_OBJ            = "MODULE"
 )
 
 type Environment struct {
 	store map[string]Object
 	outer *Environment
+
+	importer Importer
 }
 
+// Importer : load the module imported as path by the import expression at pos, returning the hash of its exported
+// bindings or an error
+type Importer func(path string, pos token.Position) Object
+
 func (e *Environment) Get(name string) (Object, bool) {
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
@@ -49,6 +66,32 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// Assign : update the binding of name in the innermost environment defining it, returning false if name is not defined
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[name]; ok {
+			env.store[name] = val
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// SetImporter : set the importer used by import expressions evaluated in e and in the environments it encloses
+func (e *Environment) SetImporter(importer Importer) {
+	e.importer = importer
+}
+
+// Importer : return the importer of the innermost environment having one, nil if imports are not available
+func (e *Environment) Importer() Importer {
+	for env := e; env != nil; env = env.outer {
+		if env.importer != nil {
+			return env.importer
+		}
+	}
+	return nil
+}
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
 	return &Environment{store: s, outer: nil}
@@ -81,6 +124,30 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+
+// Inspect : shortest representation of the value, always recognizable as a float (1.0 rather than 1)
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// HashKey : the key of the integer of the same value when the float has an integral value, since they are equal, and
+// a key made of the bits of the float otherwise
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && f.Value >= math.MinInt64 && f.Value < math.MaxInt64 {
+		return (&Integer{Value: int64(f.Value)}).HashKey() // -0.0 and 0.0 both give the key of 0
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 type Boolean struct {
 	Value bool
 }
@@ -124,31 +191,98 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// Break : signal of a break statement, unwinding the evaluation of blocks up to the enclosing loop
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+// Continue : signal of a continue statement, unwinding the evaluation of blocks up to the enclosing loop
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
+// Kinds of the errors raised by both engines, seen by scripts as the "type" of the errors they catch
+const (
+	USER_ERROR          = "Error" // errors thrown with a message by throw statements
+	TYPE_ERROR          = "TypeError"
+	NAME_ERROR          = "NameError"
+	INDEX_ERROR         = "IndexError"
+	ZERO_DIVISION_ERROR = "ZeroDivisionError"
+	ARGUMENT_ERROR      = "ArgumentError"
+	IMPORT_ERROR        = "ImportError"
+	PATTERN_ERROR       = "PatternError" // values not matching the pattern of a destructuring let statement
+	RUNTIME_ERROR       = "RuntimeError"
+)
+
+// Error : a runtime error. Errors are values: they are raised by wrapping them in an Exception, and once caught they
+// can be stored, passed around or thrown again
 type Error struct {
+	Kind    string
 	Message string
+	Pos     token.Position
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+func (e *Error) Inspect() string {
+	if e.Pos.IsValid() {
+		return "ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "ERROR: " + e.Message
+}
+
+// Error : the message of the error prefixed by its position, so that errors can be returned as Go errors
+func (e *Error) Error() string {
+	if e.Pos.IsValid() {
+		return e.Pos.String() + ": " + e.Message
+	}
+	return e.Message
+}
+
+// Field : return the value of the "type" or "message" key of an error indexed by a script
+func (e *Error) Field(key Object) (Object, bool) {
+	name, ok := key.(*String)
+	if !ok {
+		return nil, false
+	}
+
+	switch name.Value {
+	case "type":
+		return &String{Value: e.Kind}, true
+	case "message":
+		return &String{Value: e.Message}, true
+	default:
+		return nil, false
+	}
+}
+
+// Exception : signal of an error being thrown, unwinding the evaluation up to the closest try expression. Builtins
+// return exceptions to report failures
+type Exception struct {
+	Error *Error
+}
+
+func (ex *Exception) Type() ObjectType { return EXCEPTION_OBJ }
+func (ex *Exception) Inspect() string  { return ex.Error.Inspect() }
 
 type Function struct {
 	Parameters []*ast.Identifier
+	Defaults   []ast.Expression
+	Rest       *ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+
+	Name string
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
 func (f *Function) Inspect() string {
 	var out bytes.Buffer
 
-	params := []string{}
-	for _, p := range f.Parameters {
-		params = append(params, p.String())
-	}
-
 	out.WriteString("fn")
 	out.WriteString("(")
-	out.WriteString(strings.Join(params, ", "))
+	out.WriteString(ast.FormatParameters(f.Parameters, f.Defaults, f.Rest))
 	out.WriteString(") {\n")
 	out.WriteString(f.Body.String())
 	out.WriteString("\n}")
@@ -156,10 +290,30 @@ func (f *Function) Inspect() string {
 	return out.String()
 }
 
+// Arity : report how many arguments the function accepts
+func (f *Function) Arity() Arity {
+	arity := Arity{Max: len(f.Parameters)}
+	for i := range f.Parameters {
+		if i >= len(f.Defaults) || f.Defaults[i] == nil {
+			arity.Min++
+		}
+	}
+	if f.Rest != nil {
+		arity.Max = -1
+	}
+	return arity
+}
+
+// CompiledFunction : NumParameters counts the named parameters, the last NumDefaults of which have a default value.
+// A variadic function has one more local after them, holding the array of the extra arguments
 type CompiledFunction struct {
 	Instructions  code.Instructions
+	SourceMap     code.SourceMap
 	NumLocals     int
 	NumParameters int
+	NumDefaults   int
+	Variadic      bool
+	Name          string
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -167,9 +321,59 @@ func (cf *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", cf)
 }
 
+// Arity : report how many arguments the function accepts
+func (cf *CompiledFunction) Arity() Arity {
+	arity := Arity{Min: cf.NumParameters - cf.NumDefaults, Max: cf.NumParameters}
+	if cf.Variadic {
+		arity.Max = -1
+	}
+	return arity
+}
+
+// Arity : the number of arguments a function accepts, from Min to Max. Max is -1 when there is no upper bound
+type Arity struct {
+	Min int
+	Max int
+}
+
+// Accepts : report whether a call with n arguments is valid
+func (a Arity) Accepts(n int) bool {
+	return n >= a.Min && (a.Max < 0 || n <= a.Max)
+}
+
+func (a Arity) String() string {
+	switch {
+	case a.Max < 0:
+		return fmt.Sprintf("at least %d", a.Min)
+	case a.Min == a.Max:
+		return fmt.Sprintf("%d", a.Min)
+	default:
+		return fmt.Sprintf("%d to %d", a.Min, a.Max)
+	}
+}
+
+// NewArityError : the error of calling the function called name, empty for anonymous ones, with n arguments
+func NewArityError(name string, arity Arity, n int) *Error {
+	if name == "" {
+		name = "anonymous function"
+	}
+	return &Error{
+		Kind:    ARGUMENT_ERROR,
+		Message: fmt.Sprintf("wrong number of arguments to %s: want=%s, got=%d", name, arity, n),
+	}
+}
+
 type Closure struct {
 	Fn   *CompiledFunction
 	Free []Object
+	Unit *Unit
+}
+
+// Unit : constants and globals of the bytecode unit, the main program or a module, a closure was created in. A
+// closure always runs with its own unit, even when called from another module
+type Unit struct {
+	Constants []Object
+	Globals   []Object
 }
 
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
@@ -177,6 +381,34 @@ func (c *Closure) Inspect() string {
 	return fmt.Sprintf("Closure[%p]", c)
 }
 
+// Cell : box holding a local variable captured by closures, shared by the frame defining the variable and the
+// closures so that assignments are seen by all of them
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string {
+	if c.Value == nil {
+		return "cell()"
+	}
+	return "cell(" + c.Value.Inspect() + ")"
+}
+
+// CompiledModule : a module compiled to its own bytecode unit, run once by the VM in its own globals. Exports maps the
+// exported names to the indexes of their globals
+type CompiledModule struct {
+	Name         string // absolute file name of the module, identifying it at run time
+	Instructions code.Instructions
+	SourceMap    code.SourceMap
+	Constants    []Object
+	NumGlobals   int
+	Exports      map[string]int
+}
+
+func (cm *CompiledModule) Type() ObjectType { return MODULE_OBJ }
+func (cm *CompiledModule) Inspect() string  { return fmt.Sprintf("module %q", cm.Name) }
+
 type BuiltinFunction func(args ...Object) Object
 
 type Builtin struct {
@@ -236,6 +468,85 @@ func (h *Hash) Inspect() string {
 	return out.String()
 }
 
+// SortedPairs : return the pairs of the hash ordered by key, see lessKey
+func (h *Hash) SortedPairs() []HashPair {
+	pairs := make([]HashPair, 0, len(h.Pairs))
+	for _, pair := range h.Pairs {
+		pairs = append(pairs, pair)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return lessKey(pairs[i].Key, pairs[j].Key)
+	})
+
+	return pairs
+}
+
+// lessKey : order hash keys by type name first, then by value
+func lessKey(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *Float:
+		return a.Value < b.(*Float).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	default:
+		return a.Inspect() < b.Inspect()
+	}
+}
+
+// Iterator : state of a for loop, iterating over the elements of an array, the keys of a hash (in the order of
+// Hash.SortedPairs) or the characters of a string
+type Iterator struct {
+	items []Object
+	next  int
+}
+
+// NewIterator : return an iterator over obj, or false if obj is not iterable
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		items := make([]Object, len(obj.Elements))
+		copy(items, obj.Elements)
+		return &Iterator{items: items}, true
+	case *Hash:
+		items := []Object{}
+		for _, pair := range obj.SortedPairs() {
+			items = append(items, pair.Key)
+		}
+		return &Iterator{items: items}, true
+	case *String:
+		items := []Object{}
+		for _, ch := range obj.Value {
+			items = append(items, &String{Value: string(ch)})
+		}
+		return &Iterator{items: items}, true
+	default:
+		return nil, false
+	}
+}
+
+// Next : return the next item, or false once the iteration is over
+func (it *Iterator) Next() (Object, bool) {
+	if it.next >= len(it.items) {
+		return nil, false
+	}
+
+	item := it.items[it.next]
+	it.next++
+	return item, true
+}
+
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+func (it *Iterator) Inspect() string  { return "iterator" }
+
 type Quote struct {
 	Node ast.Node
 }
@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -36,6 +39,53 @@ func TestIntegerHashKey(t *testing.T) {
 	}
 }
 
+func TestFloatHashKey(t *testing.T) {
+	hello1 := &Float{Value: 1.5}
+	hello2 := &Float{Value: 1.5}
+	diff1 := &Float{Value: 0}
+	diff2 := &Float{Value: math.Copysign(0, -1)}
+
+	if hello1.HashKey() != hello2.HashKey() {
+		t.Errorf("floats with same content have different hash keys")
+	}
+	if diff1.HashKey() != diff2.HashKey() {
+		t.Errorf("positive and negative zero have different hash keys")
+	}
+	if hello1.HashKey() == diff1.HashKey() {
+		t.Errorf("floats with different content have same hash keys")
+	}
+
+	// equal numbers have the same key
+	for _, value := range []int64{0, 1, -7, 1 << 40} {
+		if (&Float{Value: float64(value)}).HashKey() != (&Integer{Value: value}).HashKey() {
+			t.Errorf("float %d.0 and integer %d have different hash keys", value, value)
+		}
+	}
+	if (&Float{Value: 1.5}).HashKey() == (&Integer{Value: 1}).HashKey() {
+		t.Errorf("float 1.5 and integer 1 have same hash keys")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1, "1.0"},
+		{2.5, "2.5"},
+		{-0.125, "-0.125"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong Inspect for %g. want=%q, got=%q", tt.value, tt.expected, f.Inspect())
+		}
+	}
+}
+
 func TestBooleanHashKey(t *testing.T) {
 	hello1 := &Boolean{Value: true}
 	hello2 := &Boolean{Value: true}
@@ -52,3 +102,81 @@ func TestBooleanHashKey(t *testing.T) {
 		t.Errorf("booleans with different content have same hash keys")
 	}
 }
+
+func TestEqual(t *testing.T) {
+	hash := func(pairs ...Object) *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		for i := 0; i < len(pairs); i += 2 {
+			key := pairs[i].(Hashable).HashKey()
+			h.Pairs[key] = HashPair{Key: pairs[i], Value: pairs[i+1]}
+		}
+		return h
+	}
+	array := func(elements ...Object) *Array { return &Array{Elements: elements} }
+	fn := &Closure{}
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{&Integer{Value: 1}, &Integer{Value: 1}, true},
+		{&Integer{Value: 1}, &Float{Value: 1}, true},
+		{&Float{Value: 1.5}, &Integer{Value: 1}, false},
+		{&Float{Value: math.NaN()}, &Float{Value: math.NaN()}, false},
+		{&String{Value: "a"}, &String{Value: "a"}, true},
+		{&String{Value: "a"}, &String{Value: "b"}, false},
+		{&String{Value: "1"}, &Integer{Value: 1}, false},
+		{&Boolean{Value: true}, &Boolean{Value: true}, true},
+		{&Boolean{Value: false}, &Null{}, false},
+		{&Null{}, &Null{}, true},
+		{array(), array(), true},
+		{array(&Integer{Value: 1}, array(&String{Value: "x"})), array(&Integer{Value: 1}, array(&String{Value: "x"})), true},
+		{array(&Integer{Value: 1}), array(&Integer{Value: 1}, &Integer{Value: 2}), false},
+		{array(&Integer{Value: 1}), array(&Integer{Value: 2}), false},
+		{hash(&String{Value: "a"}, &Integer{Value: 1}), hash(&String{Value: "a"}, &Float{Value: 1}), true},
+		{hash(&String{Value: "a"}, &Integer{Value: 1}), hash(&String{Value: "b"}, &Integer{Value: 1}), false},
+		{hash(&String{Value: "a"}, &Integer{Value: 1}), hash(), false},
+		{hash(), array(), false},
+		{fn, fn, true},
+		{fn, &Closure{}, false},
+	}
+
+	for i, tt := range tests {
+		if got := Equal(tt.a, tt.b); got != tt.expected {
+			t.Errorf("tests[%d] - Equal(%s, %s) wrong. expected=%t, got=%t", i, tt.a.Inspect(), tt.b.Inspect(), tt.expected, got)
+		}
+		if got := Equal(tt.b, tt.a); got != tt.expected {
+			t.Errorf("tests[%d] - Equal(%s, %s) wrong. expected=%t, got=%t", i, tt.b.Inspect(), tt.a.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestArity(t *testing.T) {
+	tests := []struct {
+		fn       *CompiledFunction
+		expected string
+		accepts  []int
+		rejects  []int
+	}{
+		{&CompiledFunction{NumParameters: 2}, "2", []int{2}, []int{1, 3}},
+		{&CompiledFunction{NumParameters: 3, NumDefaults: 2}, "1 to 3", []int{1, 2, 3}, []int{0, 4}},
+		{&CompiledFunction{NumParameters: 1, Variadic: true}, "at least 1", []int{1, 2, 10}, []int{0}},
+	}
+
+	for _, tt := range tests {
+		arity := tt.fn.Arity()
+		if arity.String() != tt.expected {
+			t.Errorf("wrong arity. want=%q, got=%q", tt.expected, arity)
+		}
+		for _, n := range tt.accepts {
+			if !arity.Accepts(n) {
+				t.Errorf("arity %s does not accept %d arguments", arity, n)
+			}
+		}
+		for _, n := range tt.rejects {
+			if arity.Accepts(n) {
+				t.Errorf("arity %s accepts %d arguments", arity, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package object
+
+import "fmt"
+
+// UnpackArray : return the elements of value matched by an array pattern of n elements, followed by the array of the
+// remaining elements when the pattern has a rest element. Both engines destructure values with UnpackArray and
+// UnpackHash, so they report the same errors
+func UnpackArray(value Object, n int, rest bool) ([]Object, *Error) {
+	arr, ok := value.(*Array)
+	if !ok {
+		return nil, newPatternError("cannot destructure %s with an array pattern", value.Type())
+	}
+
+	want := Arity{Min: n, Max: n}
+	if rest {
+		want.Max = -1
+	}
+	if !want.Accepts(len(arr.Elements)) {
+		return nil, newPatternError("wrong number of elements to destructure: want=%s, got=%d", want, len(arr.Elements))
+	}
+
+	values := make([]Object, n, n+1)
+	copy(values, arr.Elements)
+	if rest {
+		remaining := make([]Object, len(arr.Elements)-n)
+		copy(remaining, arr.Elements[n:])
+		values = append(values, &Array{Elements: remaining})
+	}
+
+	return values, nil
+}
+
+// UnpackHash : return the values of the string keys matched by a hash pattern. Errors can be destructured too, with
+// their "type" and "message" keys
+func UnpackHash(value Object, keys []string) ([]Object, *Error) {
+	var lookup func(key *String) (Object, bool)
+
+	switch value := value.(type) {
+	case *Hash:
+		lookup = func(key *String) (Object, bool) {
+			pair, ok := value.Pairs[key.HashKey()]
+			return pair.Value, ok
+		}
+	case *Error:
+		lookup = func(key *String) (Object, bool) { return value.Field(key) }
+	default:
+		return nil, newPatternError("cannot destructure %s with a hash pattern", value.Type())
+	}
+
+	values := make([]Object, len(keys))
+	for i, key := range keys {
+		v, ok := lookup(&String{Value: key})
+		if !ok {
+			return nil, newPatternError("cannot destructure missing key %q", key)
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func newPatternError(format string, a ...interface{}) *Error {
+	return &Error{Kind: PATTERN_ERROR, Message: fmt.Sprintf(format, a...)}
+}
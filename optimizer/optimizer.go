@@ -0,0 +1,326 @@
+// package optimizer
+// rewrite a macro-expanded program before it is compiled: fold constant expressions, prune the branches of
+// conditionals whose condition is constant and drop the expression statements whose value is unused and that have no
+// side effects. Operations that would fail at run time are left as they are, so their errors are raised as before
+
+package optimizer
+
+import (
+	"monkey/ast"
+	"monkey/token"
+	"strconv"
+)
+
+// Optimize : optimize program in place and return it
+func Optimize(program *ast.Program) *ast.Program {
+	program.Statements = optimizeStatements(program.Statements)
+	return program
+}
+
+// optimizeStatements : optimize a list of statements. Conditionals with a constant condition are replaced by the
+// statements of the branch taken, and constant expressions are dropped unless they are the value of the list
+func optimizeStatements(stmts []ast.Statement) []ast.Statement {
+	result := []ast.Statement{}
+
+	for i, stmt := range stmts {
+		stmt = optimizeStatement(stmt)
+		last := i == len(stmts)-1
+
+		es, ok := stmt.(*ast.ExpressionStatement)
+		if !ok {
+			result = append(result, stmt)
+			continue
+		}
+
+		if ie, ok := es.Expression.(*ast.IfExpression); ok {
+			if branch, ok := constantBranch(ie); ok && (!last || endsWithExpression(branch)) {
+				if branch != nil {
+					result = append(result, branch.Statements...)
+				}
+				continue
+			}
+		}
+
+		if !last && isPure(es.Expression) {
+			continue
+		}
+
+		result = append(result, stmt)
+	}
+
+	return result
+}
+
+func optimizeStatement(stmt ast.Statement) ast.Statement {
+	switch stmt := stmt.(type) {
+	case *ast.ExpressionStatement:
+		stmt.Expression = optimizeExpression(stmt.Expression)
+	case *ast.LetStatement:
+		stmt.Value = optimizeExpression(stmt.Value)
+	case *ast.ReturnStatement:
+		stmt.ReturnValue = optimizeExpression(stmt.ReturnValue)
+	case *ast.ThrowStatement:
+		stmt.Value = optimizeExpression(stmt.Value)
+	case *ast.WhileStatement:
+		stmt.Condition = optimizeExpression(stmt.Condition)
+		optimizeBlock(stmt.Body)
+	case *ast.ForStatement:
+		stmt.Iterable = optimizeExpression(stmt.Iterable)
+		optimizeBlock(stmt.Body)
+	case *ast.BlockStatement:
+		optimizeBlock(stmt)
+	}
+
+	return stmt
+}
+
+func optimizeBlock(block *ast.BlockStatement) {
+	if block != nil {
+		block.Statements = optimizeStatements(block.Statements)
+	}
+}
+
+func optimizeExpression(expr ast.Expression) ast.Expression {
+	switch expr := expr.(type) {
+	case *ast.PrefixExpression:
+		expr.Right = optimizeExpression(expr.Right)
+		return foldPrefix(expr)
+	case *ast.InfixExpression:
+		expr.Left = optimizeExpression(expr.Left)
+		expr.Right = optimizeExpression(expr.Right)
+		return foldInfix(expr)
+	case *ast.IfExpression:
+		expr.Condition = optimizeExpression(expr.Condition)
+		optimizeBlock(expr.Consequence)
+		optimizeBlock(expr.Alternative)
+
+		// a branch made of a single expression is the value of the conditional
+		if branch, ok := constantBranch(expr); ok && branch != nil && len(branch.Statements) == 1 {
+			if es, ok := branch.Statements[0].(*ast.ExpressionStatement); ok {
+				return es.Expression
+			}
+		}
+	case *ast.IndexExpression:
+		expr.Left = optimizeExpression(expr.Left)
+		expr.Index = optimizeExpression(expr.Index)
+	case *ast.AssignExpression:
+		expr.Target = optimizeExpression(expr.Target)
+		expr.Value = optimizeExpression(expr.Value)
+	case *ast.TryExpression:
+		optimizeBlock(expr.Body)
+		optimizeBlock(expr.Catch)
+		optimizeBlock(expr.Finally)
+	case *ast.FunctionLiteral:
+		for i := range expr.Defaults {
+			expr.Defaults[i] = optimizeExpression(expr.Defaults[i])
+		}
+		optimizeBlock(expr.Body)
+	case *ast.CallExpression:
+		// quoted code is a value, which must stay as written
+		if expr.Function.TokenLiteral() == "quote" {
+			return expr
+		}
+
+		expr.Function = optimizeExpression(expr.Function)
+		for i := range expr.Arguments {
+			expr.Arguments[i] = optimizeExpression(expr.Arguments[i])
+		}
+	case *ast.ArrayLiteral:
+		for i := range expr.Elements {
+			expr.Elements[i] = optimizeExpression(expr.Elements[i])
+		}
+	case *ast.HashLiteral:
+		pairs := make(map[ast.Expression]ast.Expression, len(expr.Pairs))
+		for key, value := range expr.Pairs {
+			pairs[optimizeExpression(key)] = optimizeExpression(value)
+		}
+		expr.Pairs = pairs
+	}
+
+	return expr
+}
+
+// foldPrefix : the literal value of a negated integer or of the negation of a constant, or expr itself
+func foldPrefix(expr *ast.PrefixExpression) ast.Expression {
+	switch expr.Operator {
+	case "-":
+		if right, ok := expr.Right.(*ast.IntegerLiteral); ok {
+			return newInteger(expr.Pos(), -right.Value)
+		}
+	case "!":
+		if truthy, ok := constantTruthiness(expr.Right); ok {
+			return newBoolean(expr.Pos(), !truthy)
+		}
+	}
+
+	return expr
+}
+
+// foldInfix : the literal value of an operation between constants, or expr itself when it is not constant or would
+// fail at run time
+func foldInfix(expr *ast.InfixExpression) ast.Expression {
+	pos := expr.Pos()
+
+	if expr.Operator == "&&" || expr.Operator == "||" {
+		left, ok := constantTruthiness(expr.Left)
+		if !ok {
+			return expr
+		}
+		if left == (expr.Operator == "||") {
+			return newBoolean(pos, left)
+		}
+		if right, ok := constantTruthiness(expr.Right); ok {
+			return newBoolean(pos, right)
+		}
+		return expr
+	}
+
+	switch left := expr.Left.(type) {
+	case *ast.IntegerLiteral:
+		right, ok := expr.Right.(*ast.IntegerLiteral)
+		if !ok {
+			return expr
+		}
+
+		switch expr.Operator {
+		case "+":
+			return newInteger(pos, left.Value+right.Value)
+		case "-":
+			return newInteger(pos, left.Value-right.Value)
+		case "*":
+			return newInteger(pos, left.Value*right.Value)
+		case "/":
+			if right.Value != 0 {
+				return newInteger(pos, left.Value/right.Value)
+			}
+		case "%":
+			if right.Value != 0 {
+				return newInteger(pos, left.Value%right.Value)
+			}
+		case "<":
+			return newBoolean(pos, left.Value < right.Value)
+		case ">":
+			return newBoolean(pos, left.Value > right.Value)
+		case "<=":
+			return newBoolean(pos, left.Value <= right.Value)
+		case ">=":
+			return newBoolean(pos, left.Value >= right.Value)
+		case "==":
+			return newBoolean(pos, left.Value == right.Value)
+		case "!=":
+			return newBoolean(pos, left.Value != right.Value)
+		}
+	case *ast.StringLiteral:
+		right, ok := expr.Right.(*ast.StringLiteral)
+		if !ok {
+			return expr
+		}
+
+		switch expr.Operator {
+		case "+":
+			return newString(pos, left.Value+right.Value)
+		case "==":
+			return newBoolean(pos, left.Value == right.Value)
+		case "!=":
+			return newBoolean(pos, left.Value != right.Value)
+		}
+	case *ast.Boolean:
+		right, ok := expr.Right.(*ast.Boolean)
+		if !ok {
+			return expr
+		}
+
+		switch expr.Operator {
+		case "==":
+			return newBoolean(pos, left.Value == right.Value)
+		case "!=":
+			return newBoolean(pos, left.Value != right.Value)
+		}
+	}
+
+	return expr
+}
+
+// constantBranch : the branch taken by a conditional whose condition is constant, nil when it is false and there is
+// no alternative
+func constantBranch(expr *ast.IfExpression) (*ast.BlockStatement, bool) {
+	truthy, ok := constantTruthiness(expr.Condition)
+	if !ok {
+		return nil, false
+	}
+	if truthy {
+		return expr.Consequence, true
+	}
+	return expr.Alternative, true
+}
+
+// constantTruthiness : whether a literal is truthy, ok being false when expr is not a literal
+func constantTruthiness(expr ast.Expression) (truthy bool, ok bool) {
+	switch expr := expr.(type) {
+	case *ast.Boolean:
+		return expr.Value, true
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral:
+		return true, true
+	default:
+		return false, false
+	}
+}
+
+// endsWithExpression : whether the value of a branch is that of its last statement, so that replacing a conditional
+// by the branch keeps the value of the list it ends
+func endsWithExpression(block *ast.BlockStatement) bool {
+	if block == nil || len(block.Statements) == 0 {
+		return false
+	}
+	_, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement)
+	return ok
+}
+
+// isPure : whether evaluating expr can neither fail nor change anything
+func isPure(expr ast.Expression) bool {
+	switch expr := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral, *ast.Boolean:
+		return true
+	case *ast.PrefixExpression:
+		return expr.Operator == "!" && isPure(expr.Right)
+	case *ast.ArrayLiteral:
+		for _, el := range expr.Elements {
+			if !isPure(el) {
+				return false
+			}
+		}
+		return true
+	case *ast.HashLiteral:
+		for key, value := range expr.Pairs {
+			switch key.(type) {
+			case *ast.IntegerLiteral, *ast.StringLiteral, *ast.Boolean:
+			default:
+				return false
+			}
+			if !isPure(value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func newInteger(pos token.Position, value int64) *ast.IntegerLiteral {
+	tok := token.Token{Type: token.INT, Literal: strconv.FormatInt(value, 10), Pos: pos}
+	return &ast.IntegerLiteral{Token: tok, Value: value}
+}
+
+func newString(pos token.Position, value string) *ast.StringLiteral {
+	tok := token.Token{Type: token.STRING, Literal: value, Pos: pos}
+	return &ast.StringLiteral{Token: tok, Value: value}
+}
+
+func newBoolean(pos token.Position, value bool) *ast.Boolean {
+	tok := token.Token{Type: token.FALSE, Literal: "false", Pos: pos}
+	if value {
+		tok = token.Token{Type: token.TRUE, Literal: "true", Pos: pos}
+	}
+	return &ast.Boolean{Token: tok, Value: value}
+}
@@ -0,0 +1,74 @@
+package optimizer
+
+import (
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"-(4 - 10) / 4 % 5", "1"},
+		{"1 < 2 == true", "true"},
+		{`"mon" + "key"`, "monkey"},
+		{`"a" != "b"`, "true"},
+		{"!0", "false"},
+		{"!!true", "true"},
+		{"true && false || true", "true"},
+		{"false && f()", "false"},
+		{"true || f()", "true"},
+		{"true && f()", "(true && f())"},
+		{"x + 1 * 2", "(x + 2)"},
+		{"1 / 0", "(1 / 0)"},
+		{"1 % (2 - 2)", "(1 % 0)"},
+		{`1 + "a"`, "(1 + a)"},
+		{`"a" - "b"`, "(a - b)"},
+		{"-true", "(-true)"},
+		{"1.5 + 1", "(1.5 + 1)"},
+		{"let x = if (1 < 2) { 10 } else { 20 };", "let x = 10;"},
+		{"let x = if (false) { 10 } else { y; 20 };", "let x = iffalse 10else y20;"},
+		{"if (true) { let a = 1; a } else { 2 }", "let a = 1;a"},
+		{"if (false) { f() }; 1", "1"},
+		{"if (false) { f() }", "iffalse f()"},
+		{"if (x) { 1 + 1 } else { 3 }", "ifx 2else 3"},
+		{"1; \"a\"; [2, {3: !4}]; f(); x; 5", "f()x5"},
+		{"[f()]; {[]: 1}; -x; 2", "[f()]{[]:1}(-x)2"},
+		{"fn(a = 2 * 3) { 1; a }", "fn(a = 6) a"},
+		{"while (x) { 1; if (true) { f() } }", "whilex f()"},
+		{"quote(1 + 2) + (3 + 4)", "(quote((1 + 2)) + 7)"},
+	}
+
+	for _, tt := range tests {
+		program := Optimize(parse(t, tt.input))
+
+		if program.String() != tt.expected {
+			t.Errorf("wrong optimization of %q. want=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestFoldedPositions(t *testing.T) {
+	program := Optimize(parse(t, "let x =\n  1 + 2;"))
+
+	let := program.Statements[0].(*ast.LetStatement)
+	if let.Value.Pos().String() != "2:5" {
+		t.Errorf("wrong position of the folded expression. want=%q, got=%q", "2:5", let.Value.Pos())
+	}
+}
+
+func parse(t *testing.T, input string) *ast.Program {
+	t.Helper()
+
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		t.Fatalf("parser errors for %q: %v", input, p.Errors())
+	}
+
+	return program
+}
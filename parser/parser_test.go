@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/lexer"
+	"strings"
 	"testing"
 )
 
@@ -77,6 +78,58 @@ func testLetStatement(t *testing.T, s ast.Statement, name string) bool {
 	return true
 }
 
+func TestLetPatternParsing(t *testing.T) {
+	tests := []struct {
+		input         string
+		expected      string
+		expectedNames []string
+	}{
+		{"let [a, b] = pair;", "let [a, b] = pair;", []string{"a", "b"}},
+		{"let [] = x;", "let [] = x;", []string{}},
+		{"let [first, ...rest] = [1, 2, 3];", "let [first, ...rest] = [1, 2, 3];", []string{"first", "rest"}},
+		{"let [...all] = x", "let [...all] = x;", []string{"all"}},
+		{"let {name, age} = person;", "let {name, age} = person;", []string{"name", "age"}},
+		{"let {name: n, age,} = person;", "let {name: n, age} = person;", []string{"n", "age"}},
+		{
+			"let [a, [b, c], {d: [e, ...f], g}] = x;",
+			"let [a, [b, c], {d: [e, ...f], g}] = x;",
+			[]string{"a", "b", "c", "e", "f", "g"},
+		},
+		{"export let {x, y} = point;", "export let {x, y} = point;", []string{"x", "y"}},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.LetStatement)
+		if !ok {
+			t.Fatalf("statement is not *ast.LetStatement. got=%T", program.Statements[0])
+		}
+		if stmt.Name != nil || stmt.Pattern == nil {
+			t.Fatalf("let statement has no pattern. Name=%v Pattern=%v", stmt.Name, stmt.Pattern)
+		}
+
+		if stmt.String() != tt.expected {
+			t.Errorf("String() wrong. expected=%q, got=%q", tt.expected, stmt.String())
+		}
+
+		names := []string{}
+		for _, name := range stmt.Names() {
+			names = append(names, name.Value)
+		}
+		if strings.Join(names, " ") != strings.Join(tt.expectedNames, " ") {
+			t.Errorf("Names() wrong for %q. expected=%v, got=%v", tt.input, tt.expectedNames, names)
+		}
+	}
+}
+
 func TestReturnStatements(t *testing.T) {
 	tests := []struct {
 		input         string
@@ -289,6 +342,155 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.25;", 3.25},
+		{"1e3;", 1000},
+		{"2.5e-1;", 0.25},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program has not 1 statement. got=%d", len(program.Statements))
+		}
+
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+		}
+
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral, got %T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
+func TestWhileStatement(t *testing.T) {
+	input := "while (x < y) { x; break; continue; }"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not 1 statement. got=%d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T", program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body has not 3 statements. got=%d", len(stmt.Body.Statements))
+	}
+
+	body, ok := stmt.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Statements[0] is not *ast.ExpressionStatement, got=%T", stmt.Body.Statements[0])
+	}
+	if !testIdentifier(t, body.Expression, "x") {
+		return
+	}
+
+	if _, ok := stmt.Body.Statements[1].(*ast.BreakStatement); !ok {
+		t.Errorf("Statements[1] is not *ast.BreakStatement, got=%T", stmt.Body.Statements[1])
+	}
+	if _, ok := stmt.Body.Statements[2].(*ast.ContinueStatement); !ok {
+		t.Errorf("Statements[2] is not *ast.ContinueStatement, got=%T", stmt.Body.Statements[2])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	input := "for (item in [1, 2]) { item; };"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not 1 statement. got=%d", len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ForStatement. got=%T", program.Statements[0])
+	}
+
+	if stmt.Variable.Value != "item" {
+		t.Errorf("loop variable is not %q. got=%q", "item", stmt.Variable.Value)
+	}
+
+	if stmt.Iterable.String() != "[1, 2]" {
+		t.Errorf("iterable is not %q. got=%q", "[1, 2]", stmt.Iterable.String())
+	}
+
+	if len(stmt.Body.Statements) != 1 {
+		t.Fatalf("body has not 1 statement. got=%d", len(stmt.Body.Statements))
+	}
+
+	body, ok := stmt.Body.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Statements[0] is not *ast.ExpressionStatement, got=%T", stmt.Body.Statements[0])
+	}
+	testIdentifier(t, body.Expression, "item")
+}
+
+func TestLoopControlErrors(t *testing.T) {
+	tests := []struct {
+		input         string
+		expectedError string // first error reported, empty if the input is valid
+	}{
+		{"break;", "1:1: break outside loop"},
+		{"if (true) { continue; }", "1:13: continue outside loop"},
+		{"while (true) { fn() { break; } }", "1:23: break outside loop"},
+		{"while (true) { if (x) { break; } else { continue; } }", ""},
+		{"for (x in y) { for (z in x) { break; }; continue; }", ""},
+		{"for (1 in y) { }", "1:6: expected next token to be IDENT, got INT instead"},
+		{"for (x y) { }", "1:8: expected next token to be IN, got IDENT instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if tt.expectedError == "" {
+			if len(errors) != 0 {
+				t.Errorf("unexpected errors for %q: %v", tt.input, errors)
+			}
+			continue
+		}
+
+		if len(errors) == 0 {
+			t.Errorf("expected parser errors for %q, got none", tt.input)
+			continue
+		}
+		if errors[0] != tt.expectedError {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expectedError, errors[0])
+		}
+	}
+}
+
 func TestFunctionLiteralParsing(t *testing.T) {
 	input := "fn(x, y) { x + y }"
 
@@ -404,6 +606,72 @@ func TestFunctionParameterParsing(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameterParsing(t *testing.T) {
+	tests := []struct {
+		input            string
+		expectedParams   []string
+		expectedDefaults []string
+		expectedRest     string
+	}{
+		{"fn(a, b = 2) {}", []string{"a", "b"}, []string{"", "2"}, ""},
+		{"fn(a = 1, b = (a * 2)) {}", []string{"a", "b"}, []string{"1", "(a * 2)"}, ""},
+		{"fn(...rest) {}", []string{}, nil, "rest"},
+		{"fn(a, b = [1, 2], ...rest) {}", []string{"a", "b"}, []string{"", "[1, 2]"}, "rest"},
+		{"fn(a, ...rest) {}", []string{"a"}, nil, "rest"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		function, ok := stmt.Expression.(*ast.FunctionLiteral)
+		if !ok {
+			t.Fatalf("stmt is not ast.FunctionLiteral. got=%T", stmt.Expression)
+		}
+
+		if len(function.Parameters) != len(tt.expectedParams) {
+			t.Fatalf("length parameters wrong. expected=%d, got=%d", len(tt.expectedParams), len(function.Parameters))
+		}
+		for i, ident := range tt.expectedParams {
+			testLiteralExpression(t, function.Parameters[i], ident)
+		}
+
+		if tt.expectedDefaults == nil {
+			if function.Defaults != nil {
+				t.Errorf("expected no defaults for %q. got=%v", tt.input, function.Defaults)
+			}
+		} else {
+			if len(function.Defaults) != len(tt.expectedDefaults) {
+				t.Fatalf("length defaults wrong. expected=%d, got=%d", len(tt.expectedDefaults), len(function.Defaults))
+			}
+			for i, expected := range tt.expectedDefaults {
+				got := ""
+				if function.Defaults[i] != nil {
+					got = function.Defaults[i].String()
+				}
+				if got != expected {
+					t.Errorf("default %d wrong for %q. expected=%q, got=%q", i, tt.input, expected, got)
+				}
+			}
+		}
+
+		rest := ""
+		if function.Rest != nil {
+			rest = function.Rest.Value
+		}
+		if rest != tt.expectedRest {
+			t.Errorf("rest parameter wrong for %q. expected=%q, got=%q", tt.input, tt.expectedRest, rest)
+		}
+
+		if expected := strings.TrimSuffix(tt.input, "{}"); function.String() != expected {
+			t.Errorf("String() wrong. expected=%q, got=%q", expected, function.String())
+		}
+	}
+}
+
 func TestCallExpressionParsing(t *testing.T) {
 	input := "add(1, 2 * 3, 4 + 5);"
 
@@ -554,6 +822,11 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"true==true;", true, "==", true},
 		{"true!=false;", true, "!=", false},
 		{"false==false;", false, "==", false},
+		{"5<=5;", 5, "<=", 5},
+		{"5>=5;", 5, ">=", 5},
+		{"5%5;", 5, "%", 5},
+		{"true&&false;", true, "&&", false},
+		{"false||true;", false, "||", true},
 	}
 
 	for _, tt := range infixTests {
@@ -586,6 +859,22 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"1 + (2 + 3) + 4",
 			"((1 + (2 + 3)) + 4)",
 		},
+		{
+			"a + b % c <= d * e",
+			"((a + (b % c)) <= (d * e))",
+		},
+		{
+			"a || b && c || d",
+			"((a || (b && c)) || d)",
+		},
+		{
+			"a < b && !c == d",
+			"((a < b) && ((!c) == d))",
+		},
+		{
+			"x = a || b",
+			"(x = (a || b))",
+		},
 		{
 			"(5 + 5) * 2",
 			"((5 + 5) * 2)",
@@ -862,6 +1151,158 @@ func TestParsingIndexExpression(t *testing.T) {
 	}
 }
 
+func TestAssignExpressionParsing(t *testing.T) {
+	tests := []struct {
+		input          string
+		expectedTarget string
+		expectedValue  string
+	}{
+		{"x = 5;", "x", "5"},
+		{"x = y + 1;", "x", "(y + 1)"},
+		{"arr[i + 1] = 2;", "(arr[(i + 1)])", "2"},
+		{"h[\"a\"][0] = fn(x) { x };", "((h[a])[0])", "fn(x) x"},
+		{"a = b = 3;", "a", "(b = 3)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+		}
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		assign, ok := stmt.Expression.(*ast.AssignExpression)
+		if !ok {
+			t.Fatalf("exp not *ast.AssignExpression. got=%T", stmt.Expression)
+		}
+
+		if assign.Target.String() != tt.expectedTarget {
+			t.Errorf("target wrong. expected=%q, got=%q", tt.expectedTarget, assign.Target.String())
+		}
+		if assign.Value.String() != tt.expectedValue {
+			t.Errorf("value wrong. expected=%q, got=%q", tt.expectedValue, assign.Value.String())
+		}
+	}
+}
+
+func TestImportExportParsing(t *testing.T) {
+	input := `
+let m = import "lib/math";
+export let square = fn(x) { x * x };
+let hidden = 1;
+`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("program.Statements does not contain 3 statements. got=%d", len(program.Statements))
+	}
+
+	imp, ok := program.Statements[0].(*ast.LetStatement).Value.(*ast.ImportExpression)
+	if !ok {
+		t.Fatalf("value not *ast.ImportExpression. got=%T", program.Statements[0].(*ast.LetStatement).Value)
+	}
+	if imp.Path != "lib/math" {
+		t.Errorf("import path wrong. expected=%q, got=%q", "lib/math", imp.Path)
+	}
+
+	tests := []struct {
+		exported bool
+		str      string
+	}{
+		{false, `let m = import "lib/math";`},
+		{true, "export let square = fn<square>(x) (x * x);"},
+		{false, "let hidden = 1;"},
+	}
+
+	for i, tt := range tests {
+		stmt := program.Statements[i].(*ast.LetStatement)
+		if stmt.Exported != tt.exported {
+			t.Errorf("statement %d - exported wrong. expected=%t, got=%t", i, tt.exported, stmt.Exported)
+		}
+		if stmt.String() != tt.str {
+			t.Errorf("statement %d - String() wrong. expected=%q, got=%q", i, tt.str, stmt.String())
+		}
+	}
+}
+
+func TestTryExpressionParsing(t *testing.T) {
+	tests := []struct {
+		input    string
+		param    string
+		catch    bool
+		finally  bool
+		expected string
+	}{
+		{"try { f() } catch (e) { 0 }", "e", true, false, "try f() catch (e) 0"},
+		{"try { f() } finally { g() }", "", false, true, "try f() finally g()"},
+		{"try { f() } catch { 0 } finally { g() }", "", true, true, "try f() catch 0 finally g()"},
+		{"try { f() } catch (err) { err } finally { g() }", "err", true, true, "try f() catch (err) err finally g()"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statement. got=%d", len(program.Statements))
+		}
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		exp, ok := stmt.Expression.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("exp not *ast.TryExpression. got=%T", stmt.Expression)
+		}
+
+		param := ""
+		if exp.Param != nil {
+			param = exp.Param.Value
+		}
+		if param != tt.param {
+			t.Errorf("catch parameter wrong. expected=%q, got=%q", tt.param, param)
+		}
+		if (exp.Catch != nil) != tt.catch {
+			t.Errorf("catch block presence wrong for %q", tt.input)
+		}
+		if (exp.Finally != nil) != tt.finally {
+			t.Errorf("finally block presence wrong for %q", tt.input)
+		}
+		if exp.String() != tt.expected {
+			t.Errorf("String() wrong. expected=%q, got=%q", tt.expected, exp.String())
+		}
+	}
+}
+
+func TestThrowStatements(t *testing.T) {
+	l := lexer.New(`throw "boom"; throw e`)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+
+	for i, expected := range []string{`throw boom;`, `throw e;`} {
+		stmt, ok := program.Statements[i].(*ast.ThrowStatement)
+		if !ok {
+			t.Fatalf("stmt not *ast.ThrowStatement. got=%T", program.Statements[i])
+		}
+		if stmt.String() != expected {
+			t.Errorf("String() wrong. expected=%q, got=%q", expected, stmt.String())
+		}
+	}
+}
+
 func TestParsingHashLiteralsStringKeys(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
 
@@ -1001,3 +1442,55 @@ func TestMacroLiteralParsing(t *testing.T) {
 
 	testInfixExpression(t, bodyStmt.Expression, "x", "+", "y")
 }
+
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x 5;", "1:7: expected next token to be =, got INT instead"},
+		{"let x = ;", "1:9: no prefix parse function for ; found"},
+		{"add(1,\n  2;", "2:4: expected next token to be ), got ; instead"},
+		{"let x = 1 @ 2;", "1:11: illegal token: @"},
+		{"let x /* a comment\nnever closed", "1:7: illegal token: unterminated block comment"},
+		{"add(1, /* unclosed", "1:8: illegal token: unterminated block comment"},
+		{"let s = \"no closing quote;", "1:9: illegal token: unterminated string"},
+		{"puts(\"\\z\")", "1:6: illegal token: unknown escape sequence \\z"},
+		{"x + 1 = 2;", "1:7: invalid assignment target (x + 1)"},
+		{"f() = 2;", "1:5: invalid assignment target f()"},
+		{"import math;", "1:8: expected next token to be STRING, got IDENT instead"},
+		{"export fn(x) { x };", "1:8: expected next token to be LET, got FUNCTION instead"},
+		{"fn() { export let x = 1; }", "1:8: export is only allowed at the top level of a program"},
+		{"try { 1 };", "1:10: expected catch or finally after try block, got ; instead"},
+		{"try { 1 } catch e { 2 }", "1:17: expected next token to be {, got IDENT instead"},
+		{"fn(a = 1, b) {}", "1:11: parameter b without a default value follows parameters with one"},
+		{"fn(...rest, a) {}", "1:11: rest parameter ...rest must be the last parameter"},
+		{"fn(...rest = 1) {}", "1:12: expected next token to be ), got = instead"},
+		{"fn(a, 1) {}", "1:7: expected next token to be IDENT, got INT instead"},
+		{"macro(a, ...rest) { a }", "1:1: macro parameters cannot have default values or a rest parameter"},
+		{"let [a, 1] = x;", "1:9: expected an identifier or a pattern, got INT instead"},
+		{"let [a b] = x;", "1:8: expected next token to be ,, got IDENT instead"},
+		{"let [...rest, a] = x;", "1:13: rest element ...rest must be the last element of the pattern"},
+		{"let {a: 1} = x;", "1:9: expected an identifier or a pattern, got INT instead"},
+		{"let {\"a\": b} = x;", "1:6: expected next token to be IDENT, got STRING instead"},
+		{"let [a, b];", "1:11: expected next token to be =, got ; instead"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+		if len(errors) > 1 && errors[0] == errors[1] {
+			t.Errorf("error reported twice for %q: %q", tt.input, errors[0])
+		}
+
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error message. expected=%q, got=%q", tt.expected, errors[0])
+		}
+	}
+}
@@ -1,5 +1,5 @@
 // package repl
-// basic Read Evaluate Print Loop. Handles one line inputs and prints its output in the terminal
+// basic Read Evaluate Print Loop. Reads programs spanning one or more lines and prints their output in the terminal
 
 package repl
 
@@ -9,14 +9,21 @@ import (
 	"io"
 	"monkey/compiler"
 	"monkey/evaluator"
+	"monkey/frontend"
 	"monkey/lexer"
+	"monkey/module"
 	"monkey/object"
 	"monkey/parser"
+	"monkey/token"
 	"monkey/vm"
+	"strings"
 	"time"
 )
 
-const PROMPT = ">> "
+const (
+	PROMPT              = ">> "
+	CONTINUATION_PROMPT = ".. "
+)
 
 func StartEval(in io.Reader, out io.Writer) {
 	io.WriteString(out, "Running engine=eval\n")
@@ -24,16 +31,15 @@ func StartEval(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 
 	env := object.NewEnvironment()
-	macroEnv := object.NewEnvironment()
+	env.SetImporter(evaluator.NewImporter(module.NewLoader(module.DefaultSearchPath())))
+	front := frontend.New()
 
 	for {
-		fmt.Printf(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, ok := readInput(scanner, out)
+		if !ok {
 			return
 		}
 
-		line := scanner.Text()
 		l := lexer.New(line)
 		p := parser.New(l)
 
@@ -43,8 +49,11 @@ func StartEval(in io.Reader, out io.Writer) {
 			continue
 		}
 
-		evaluator.DefineMacros(program, macroEnv)
-		expanded := evaluator.ExpandMacros(program, macroEnv)
+		expanded, err := front.Process(program)
+		if err != nil {
+			fmt.Fprintf(out, "Whoops! Macro expansion failed:\n%s\n", err)
+			continue
+		}
 
 		start := time.Now()
 		result := evaluator.Eval(expanded, env)
@@ -68,19 +77,19 @@ func StartVM(in io.Reader, out io.Writer) {
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalsSize)
 	symbolTable := compiler.NewSymbolTable()
+	front := frontend.New()
+	loader := module.NewLoader(module.DefaultSearchPath())
 
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
 	}
 
 	for {
-		fmt.Printf(PROMPT)
-		scanned := scanner.Scan()
-		if !scanned {
+		line, ok := readInput(scanner, out)
+		if !ok {
 			return
 		}
 
-		line := scanner.Text()
 		l := lexer.New(line)
 		p := parser.New(l)
 
@@ -90,8 +99,15 @@ func StartVM(in io.Reader, out io.Writer) {
 			continue
 		}
 
+		expanded, err := front.Process(program)
+		if err != nil {
+			fmt.Fprintf(out, "Whoops! Macro expansion failed:\n%s\n", err)
+			continue
+		}
+
 		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+		comp.SetLoader(loader)
+		err = comp.Compile(expanded)
 		if err != nil {
 			fmt.Fprintf(out, "Whoops! Compilation failed:\n%s\n", err)
 			continue
@@ -122,6 +138,68 @@ func StartVM(in io.Reader, out io.Writer) {
 	}
 }
 
+// readInput : read lines until they form a complete program, prompting for continuation lines while input is
+// incomplete. Two consecutive empty continuation lines submit the input as it is. Returns false once in is exhausted
+func readInput(scanner *bufio.Scanner, out io.Writer) (string, bool) {
+	lines := []string{}
+	prompt := PROMPT
+
+	for {
+		fmt.Fprint(out, prompt)
+		if !scanner.Scan() {
+			return "", false
+		}
+
+		line := scanner.Text()
+		if len(lines) > 1 && line == "" && lines[len(lines)-1] == "" {
+			return strings.Join(lines, "\n"), true
+		}
+
+		lines = append(lines, line)
+		input := strings.Join(lines, "\n")
+		if isComplete(input) {
+			return input, true
+		}
+
+		prompt = CONTINUATION_PROMPT
+	}
+}
+
+// isComplete : report whether input can be handed to the parser, i.e. it has no unbalanced braces, brackets or
+// parentheses, no unterminated string or block comment and does not end with an operator expecting more input
+func isComplete(input string) bool {
+	l := lexer.New(input)
+	depth := 0
+
+	var last token.Token
+	for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case token.LPAREN, token.LBRACE, token.LBRACKET:
+			depth++
+		case token.RPAREN, token.RBRACE, token.RBRACKET:
+			depth--
+		case token.ILLEGAL:
+			if tok.Literal == lexer.UnterminatedComment || tok.Literal == lexer.UnterminatedString {
+				return false
+			}
+		}
+		last = tok
+	}
+
+	if depth > 0 {
+		return false
+	}
+
+	switch last.Type {
+	case token.ASSIGN, token.PLUS, token.MINUS, token.BANG, token.ASTERISK, token.SLASH, token.PERCENT,
+		token.LT, token.GT, token.LT_EQ, token.GT_EQ, token.EQ, token.NOT_EQ, token.AND, token.OR, token.COMMA, token.COLON, token.ELSE,
+		token.CATCH, token.FINALLY, token.THROW:
+		return false
+	}
+
+	return true
+}
+
 func printParseErrors(out io.Writer, errors []string) {
 	for _, msg := range errors {
 		io.WriteString(out, "\t"+msg+"\n")
@@ -0,0 +1,84 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIsComplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"", true},
+		{"let x = 5;", true},
+		{"let add = fn(a, b) {", false},
+		{"let add = fn(a, b) {\n  a + b\n};", true},
+		{"[1, 2,", false},
+		{"[1, 2,\n3]", true},
+		{"add(1,", false},
+		{"{\"a\": 1", false},
+		{`"hello`, false},
+		{`"hello world"`, true},
+		{`"`, false},
+		{"let x = 1 +", false},
+		{"let ok = a &&", false},
+		{"let ok = a ||", false},
+		{"5 ==", false},
+		{"let x = 5 %", false},
+		{"x <=", false},
+		{"x >=", false},
+		{"if (x) { 1 } else", false},
+		{"try { f() } catch", false},
+		{"throw", false},
+		{"let x = ", false},
+		{"1 + 2)", true},
+		{"let x = 5; // a comment", true},
+		{"let x = 5 + // more to come", false},
+		{"let x = 5; /* a comment", false},
+		{"let x = 5; /* a comment\nspanning lines */", true},
+		{"fn(a) { // an open brace", false},
+		{`"say \"hi`, false},
+		{`"say \"hi\""`, true},
+		{"\"a multi-line\nstring", false},
+	}
+
+	for _, tt := range tests {
+		if got := isComplete(tt.input); got != tt.expected {
+			t.Errorf("isComplete(%q) wrong. want=%t, got=%t", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	in := "let add = fn(a, b) {\n  a + b\n};\nadd(1,\n2)\nlet broken = (\n\n\n"
+	scanner := bufio.NewScanner(strings.NewReader(in))
+	var out bytes.Buffer
+
+	expected := []string{
+		"let add = fn(a, b) {\n  a + b\n};",
+		"add(1,\n2)",
+		"let broken = (\n",
+	}
+
+	for _, want := range expected {
+		got, ok := readInput(scanner, &out)
+		if !ok {
+			t.Fatalf("input exhausted, expected %q", want)
+		}
+		if got != want {
+			t.Errorf("wrong input read. want=%q, got=%q", want, got)
+		}
+	}
+
+	if _, ok := readInput(scanner, &out); ok {
+		t.Errorf("expected input to be exhausted")
+	}
+
+	prompts := ">> .. .. >> .. >> .. .. >> "
+	if out.String() != prompts {
+		t.Errorf("wrong prompts. want=%q, got=%q", prompts, out.String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"monkey/ast"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/frontend"
+	"monkey/lexer"
+	"monkey/module"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/vm"
+	"os"
+)
+
+// runCommand : implements `monkey run <file> [--engine vm|eval]`, executing a whole source file at once
+func runCommand(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	engine := fs.String("engine", "vm", "use 'vm' or 'eval'")
+	path := pathFlag(fs)
+	optimize := optimizeFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: monkey run <file> [--engine vm|eval] [--path dirs] [--optimize=false]\n")
+		fs.PrintDefaults()
+	}
+
+	files, err := parseCommandArgs(fs, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	program, ok := loadProgram(files[0])
+	if !ok {
+		return 1
+	}
+
+	loader := module.NewLoader(module.SplitPath(*path))
+
+	switch *engine {
+	case "vm":
+		err = runVM(program, loader, *optimize)
+	case "eval":
+		err = runEval(program, loader)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine %q, use 'vm' or 'eval'\n", *engine)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// loadProgram : read, parse and macro-expand a source file. Errors are printed to stderr
+func loadProgram(path string) (ast.Node, bool) {
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil, false
+	}
+
+	l := lexer.NewWithFile(string(input), path)
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		for _, msg := range p.Errors() {
+			fmt.Fprintf(os.Stderr, "%s\n", msg)
+		}
+		return nil, false
+	}
+
+	expanded, err := frontend.New().Process(program)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil, false
+	}
+
+	return expanded, true
+}
+
+func compileProgram(program ast.Node, loader *module.Loader, optimize bool) (*compiler.Bytecode, error) {
+	comp := compiler.New()
+	comp.SetLoader(loader)
+	comp.SetOptimize(optimize)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %s", err)
+	}
+
+	return comp.Bytecode(), nil
+}
+
+func runVM(program ast.Node, loader *module.Loader, optimize bool) error {
+	bytecode, err := compileProgram(program, loader, optimize)
+	if err != nil {
+		return err
+	}
+
+	return runBytecode(bytecode)
+}
+
+func runBytecode(bytecode *compiler.Bytecode) error {
+	machine := vm.New(bytecode)
+	err := machine.Run()
+	if err != nil {
+		return fmt.Errorf("runtime error: %s", err)
+	}
+
+	return nil
+}
+
+func runEval(program ast.Node, loader *module.Loader) error {
+	env := object.NewEnvironment()
+	env.SetImporter(evaluator.NewImporter(loader))
+
+	result := evaluator.Eval(program, env)
+	if ex, ok := result.(*object.Exception); ok {
+		errObj := ex.Error
+		if errObj.Pos.IsValid() {
+			return fmt.Errorf("runtime error: %s: %s", errObj.Pos, errObj.Message)
+		}
+		return fmt.Errorf("runtime error: %s", errObj.Message)
+	}
+
+	return nil
+}
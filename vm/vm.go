@@ -2,17 +2,39 @@ package vm
 
 import (
 	"fmt"
+	"math"
 	"monkey/code"
 	"monkey/compiler"
+	"monkey/module"
 	"monkey/object"
 )
 
 const (
-	StackSize   = 2048
-	MaxFrame    = 1024
-	GlobalsSize = 65536
+	StackSize   = 2048  // default limit of the values on the stack
+	MaxFrame    = 1024  // default limit of the nested calls
+	GlobalsSize = 65536 // number of globals addressable by OpGetGlobal and OpSetGlobal
+
+	initialStackSize = 64
+	initialFrames    = 16
 )
 
+// Options : limits the stack and the frames grow up to. Zero values take the defaults StackSize and MaxFrame
+type Options struct {
+	StackSize int
+	MaxFrames int
+}
+
+// withDefaults : the options with their zero values replaced by the defaults
+func (o Options) withDefaults() Options {
+	if o.StackSize <= 0 {
+		o.StackSize = StackSize
+	}
+	if o.MaxFrames <= 0 {
+		o.MaxFrames = MaxFrame
+	}
+	return o
+}
+
 var (
 	True  = &object.Boolean{Value: true}
 	False = &object.Boolean{Value: false}
@@ -33,11 +55,20 @@ func NewFrame(cl *object.Closure, basePointer int) *Frame {
 	}
 }
 
+// handler : a try block being run. An error thrown before it is popped unwinds the frames and the stack to their
+// state when it was set up and resumes at catchIP
+type handler struct {
+	catchIP     int
+	framesIndex int
+	sp          int
+}
+
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
 
 type VM struct {
+	unit      *object.Unit // unit of the running closure, whose constants and globals are cached below
 	constants []object.Object
 
 	stack []object.Object
@@ -47,31 +78,75 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	handlers []handler // try blocks being run, innermost last
+
+	options Options
+
+	modules map[string]*object.Hash // exports of the modules already run, by name, shared with the VMs running them
 }
 
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
-	mainClosure := &object.Closure{Fn: mainFn}
+	return NewWithOptions(bytecode, Options{})
+}
+
+// NewWithOptions : a VM whose stack and frames start small and grow on demand up to the limits of opts. Globals are
+// allocated when they are first set. The VM runs its own copy of the instructions, which it quickens, so bytecode is
+// never modified and may be shared by several VMs
+func NewWithOptions(bytecode *compiler.Bytecode, opts Options) *VM {
+	mainFn := &object.CompiledFunction{
+		Instructions: copyInstructions(bytecode.Instructions),
+		SourceMap:    bytecode.SourceMap,
+	}
+	unit := &object.Unit{Constants: ownConstants(bytecode.Constants)}
+	mainClosure := &object.Closure{Fn: mainFn, Unit: unit}
 	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MaxFrame)
+	opts = opts.withDefaults()
+	frames := make([]*Frame, minInt(initialFrames, opts.MaxFrames))
 	frames[0] = mainFrame
 
 	return &VM{
-		constants: bytecode.Constants,
+		unit:      unit,
+		constants: unit.Constants,
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]object.Object, minInt(initialStackSize, opts.StackSize)),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: unit.Globals,
 
 		frames:      frames,
 		framesIndex: 1,
+
+		modules: make(map[string]*object.Hash),
+
+		options: opts,
+	}
+}
+
+// ownConstants : a copy of constants in which the compiled functions have their own instructions
+func ownConstants(constants []object.Object) []object.Object {
+	own := make([]object.Object, len(constants))
+	for i, constant := range constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			copied := *fn
+			copied.Instructions = copyInstructions(fn.Instructions)
+			constant = &copied
+		}
+		own[i] = constant
 	}
+	return own
+}
+
+func copyInstructions(ins code.Instructions) code.Instructions {
+	copied := make(code.Instructions, len(ins))
+	copy(copied, ins)
+	return copied
 }
 
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
 	vm := New(bytecode)
+	vm.unit.Globals = s
 	vm.globals = s
 	return vm
 }
@@ -80,14 +155,39 @@ func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		if vm.framesIndex >= vm.options.MaxFrames {
+			return newError(object.RUNTIME_ERROR, "stack overflow: more than %d nested calls", vm.options.MaxFrames)
+		}
+
+		frames := make([]*Frame, minInt(2*len(vm.frames), vm.options.MaxFrames))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
+
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	vm.enterUnit(f.cl.Unit)
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
 	vm.framesIndex--
-	return vm.frames[vm.framesIndex]
+	frame := vm.frames[vm.framesIndex]
+	vm.enterUnit(vm.currentFrame().cl.Unit)
+	return frame
+}
+
+// enterUnit : switch to the constants and globals of the unit the running closure was created in
+func (vm *VM) enterUnit(unit *object.Unit) {
+	if unit == nil || unit == vm.unit {
+		return
+	}
+
+	vm.unit = unit
+	vm.constants = unit.Constants
+	vm.globals = unit.Globals
 }
 
 func (vm *VM) StackTop() object.Object {
@@ -98,7 +198,71 @@ func (vm *VM) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// Run : execute the bytecode. Errors thrown at run time resume the execution at the innermost try block, uncaught
+// ones are returned as an *object.Error with the source position of the failing instruction
 func (vm *VM) Run() error {
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+
+		err = vm.throw(err)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// throw : unwind to the innermost handler and resume at its catch address, with the error on the stack. Returns the
+// error when there is no handler left
+func (vm *VM) throw(err error) error {
+	errObj, ok := err.(*object.Error)
+	if !ok {
+		errObj = newError(object.RUNTIME_ERROR, "%s", err)
+	}
+
+	if !errObj.Pos.IsValid() {
+		frame := vm.currentFrame()
+		if pos, ok := frame.cl.Fn.SourceMap.Lookup(frame.ip); ok {
+			errObj.Pos = pos
+		}
+	}
+
+	if len(vm.handlers) == 0 {
+		return errObj
+	}
+
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+
+	vm.framesIndex = h.framesIndex
+	vm.enterUnit(vm.currentFrame().cl.Unit)
+	vm.sp = h.sp
+	vm.currentFrame().ip = h.catchIP - 1
+
+	return vm.push(errObj)
+}
+
+// thrownError : the error raised by a throw statement. Errors are thrown again as they are, strings are the message
+// of a new error
+func thrownError(obj object.Object) *object.Error {
+	switch obj := obj.(type) {
+	case *object.Error:
+		return obj
+	case *object.String:
+		return newError(object.USER_ERROR, "%s", obj.Value)
+	default:
+		return newError(object.TYPE_ERROR, "cannot throw %s, only ERROR or STRING", obj.Type())
+	}
+}
+
+// newError : return a new runtime error of the given kind
+func newError(kind, format string, a ...interface{}) *object.Error {
+	return &object.Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+func (vm *VM) run() error {
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip++
 
@@ -115,11 +279,17 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
+			vm.quicken(ins, ip)
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
 			}
+		case code.OpAddInt, code.OpSubInt, code.OpMulInt, code.OpDivInt, code.OpModInt:
+			err := vm.executeQuickOperation(ins, ip)
+			if err != nil {
+				return err
+			}
 		case code.OpTrue:
 			err := vm.push(True)
 			if err != nil {
@@ -132,11 +302,18 @@ func (vm *VM) Run() error {
 			}
 		case code.OpPop:
 			vm.pop()
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan, code.OpGreaterEqual, code.OpLessEqual:
+			vm.quicken(ins, ip)
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
 			}
+		case code.OpEqualInt, code.OpNotEqualInt, code.OpGreaterThanInt, code.OpLessThanInt, code.OpGreaterEqualInt,
+			code.OpLessEqualInt:
+			err := vm.executeQuickComparison(ins, ip)
+			if err != nil {
+				return err
+			}
 		case code.OpBang:
 			err := vm.executeBangOperator()
 			if err != nil {
@@ -158,6 +335,103 @@ func (vm *VM) Run() error {
 			if !isTruthy(condition) {
 				vm.currentFrame().ip = pos - 1
 			}
+		case code.OpJumpTruthy:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition := vm.pop()
+			if isTruthy(condition) {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpCompareJumpNotTruthy:
+			comparison := code.Opcode(code.ReadUint8(ins[ip+1:]))
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			condition, err := vm.executeFusedComparison(comparison)
+			if err != nil {
+				return err
+			}
+			if !condition {
+				vm.currentFrame().ip = pos - 1
+			}
+		case code.OpUnpackArray:
+			n := int(code.ReadUint16(ins[ip+1:]))
+			rest := code.ReadUint8(ins[ip+3:]) == 1
+			vm.currentFrame().ip += 3
+
+			values, mismatch := object.UnpackArray(vm.pop(), n, rest)
+			if mismatch != nil {
+				return mismatch
+			}
+
+			err := vm.pushReversed(values)
+			if err != nil {
+				return err
+			}
+		case code.OpUnpackHash:
+			n := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			keys := make([]string, n)
+			for i, key := range vm.stack[vm.sp-n : vm.sp] {
+				keys[i] = key.(*object.String).Value
+			}
+			vm.sp -= n
+
+			values, mismatch := object.UnpackHash(vm.pop(), keys)
+			if mismatch != nil {
+				return mismatch
+			}
+
+			err := vm.pushReversed(values)
+			if err != nil {
+				return err
+			}
+		case code.OpJumpIfProvided:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			pos := int(code.ReadUint16(ins[ip+2:]))
+			vm.currentFrame().ip += 3
+
+			// callClosure leaves the slots of the missing arguments empty
+			frame := vm.currentFrame()
+			if vm.stack[frame.basePointer+int(localIndex)] != nil {
+				frame.ip = pos - 1
+			}
+		case code.OpIter:
+			iterable := vm.pop()
+			iterator, ok := object.NewIterator(iterable)
+			if !ok {
+				return newError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type())
+			}
+
+			err := vm.push(iterator)
+			if err != nil {
+				return err
+			}
+		case code.OpStackDepth:
+			err := vm.push(&object.Integer{Value: int64(vm.sp - vm.currentFrame().basePointer)})
+			if err != nil {
+				return err
+			}
+		case code.OpSetStackDepth:
+			depth := vm.pop().(*object.Integer)
+			vm.sp = vm.currentFrame().basePointer + int(depth.Value)
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			iterator := vm.pop().(*object.Iterator)
+			item, ok := iterator.Next()
+			if !ok {
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+
+			err := vm.push(item)
+			if err != nil {
+				return err
+			}
 		case code.OpNull:
 			err := vm.push(Null)
 			if err != nil {
@@ -166,12 +440,12 @@ func (vm *VM) Run() error {
 		case code.OpSetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
-			vm.globals[globalIndex] = vm.pop()
+			vm.setGlobal(int(globalIndex), vm.pop())
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIndex])
+			err := vm.push(vm.getGlobal(int(globalIndex)))
 			if err != nil {
 				return err
 			}
@@ -181,14 +455,46 @@ func (vm *VM) Run() error {
 
 			frame := vm.currentFrame()
 
-			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+			slot := frame.basePointer + int(localIndex)
+			if cell, ok := vm.stack[slot].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				vm.stack[slot] = vm.pop()
+			}
 		case code.OpGetLocal:
 			localIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip++
 
 			frame := vm.currentFrame()
 
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			err := vm.push(unwrapCell(vm.stack[frame.basePointer+int(localIndex)]))
+			if err != nil {
+				return err
+			}
+		case code.OpGetLocalAddConstant, code.OpGetLocalSubConstant:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			constIndex := code.ReadUint16(ins[ip+2:])
+			vm.currentFrame().ip += 3
+
+			local := unwrapCell(vm.stack[vm.currentFrame().basePointer+int(localIndex)])
+			err := vm.executeFusedOperation(op, local, vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			frame := vm.currentFrame()
+
+			slot := frame.basePointer + int(localIndex)
+			cell, ok := vm.stack[slot].(*object.Cell)
+			if !ok {
+				cell = &object.Cell{Value: vm.stack[slot]}
+				vm.stack[slot] = cell
+			}
+
+			err := vm.push(cell)
 			if err != nil {
 				return err
 			}
@@ -206,6 +512,25 @@ func (vm *VM) Run() error {
 			freeIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip++
 
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(unwrapCell(currentClosure.Free[freeIndex]))
+			if err != nil {
+				return err
+			}
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			currentClosure := vm.currentFrame().cl
+			if cell, ok := currentClosure.Free[freeIndex].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				currentClosure.Free[freeIndex] = vm.pop()
+			}
+		case code.OpCaptureFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.Free[freeIndex])
 			if err != nil {
@@ -244,6 +569,15 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeIndexAssignment(left, index, value)
+			if err != nil {
+				return err
+			}
 		case code.OpClosure:
 			constIndex := code.ReadUint16(ins[ip+1:])
 			numFree := code.ReadUint8(ins[ip+3:])
@@ -253,6 +587,28 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetupTry:
+			catchIP := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			vm.handlers = append(vm.handlers, handler{catchIP: catchIP, framesIndex: vm.framesIndex, sp: vm.sp})
+		case code.OpPopTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpThrow:
+			return thrownError(vm.pop())
+		case code.OpImport:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			namespace, err := vm.importModule(vm.constants[constIndex].(*object.CompiledModule))
+			if err != nil {
+				return err
+			}
+
+			err = vm.push(namespace)
+			if err != nil {
+				return err
+			}
 		case code.OpCurrentClosure:
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure)
@@ -267,6 +623,20 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpCall0, code.OpCall1, code.OpCall2:
+			// the opcodes follow each other in the order of their number of arguments
+			err := vm.executeCall(int(op - code.OpCall0))
+			if err != nil {
+				return err
+			}
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 
@@ -291,8 +661,9 @@ func (vm *VM) Run() error {
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	err := vm.ensureStack(vm.sp + 1)
+	if err != nil {
+		return err
 	}
 
 	vm.stack[vm.sp] = o
@@ -301,6 +672,63 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// ensureStack : grow the stack to hold at least size values, within the limit of the options
+func (vm *VM) ensureStack(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+	if size > vm.options.StackSize {
+		return newError(object.RUNTIME_ERROR, "stack overflow")
+	}
+
+	n := 2 * len(vm.stack)
+	for n < size {
+		n *= 2
+	}
+
+	stack := make([]object.Object, minInt(n, vm.options.StackSize))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
+// getGlobal : the value of a global, nil when it has never been set
+func (vm *VM) getGlobal(index int) object.Object {
+	if index >= len(vm.globals) {
+		return nil
+	}
+	return vm.globals[index]
+}
+
+// setGlobal : set a global, growing the globals of the current unit to hold it
+func (vm *VM) setGlobal(index int, value object.Object) {
+	if index >= len(vm.globals) {
+		n := 2 * len(vm.globals)
+		if n <= index {
+			n = index + 1
+		}
+
+		globals := make([]object.Object, minInt(n, GlobalsSize))
+		copy(globals, vm.globals)
+		vm.globals = globals
+		vm.unit.Globals = globals
+	}
+
+	vm.globals[index] = value
+}
+
+// pushReversed : push objects from the last to the first, leaving the first one on top of the stack
+func (vm *VM) pushReversed(objects []object.Object) error {
+	for i := len(objects) - 1; i >= 0; i-- {
+		err := vm.push(objects[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
 	vm.sp--
@@ -312,6 +740,163 @@ func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
 }
 
+// integerOperands : the values of the two operands on top of the stack, ok being false unless both are integers
+func (vm *VM) integerOperands() (left, right int64, ok bool) {
+	r, ok := vm.stack[vm.sp-1].(*object.Integer)
+	if !ok {
+		return 0, 0, false
+	}
+	l, ok := vm.stack[vm.sp-2].(*object.Integer)
+	if !ok {
+		return 0, 0, false
+	}
+	return l.Value, r.Value, true
+}
+
+// quicken : rewrite the generic instruction at ip to its integer specialization when both its operands are integers,
+// so that the next runs skip the dispatch on the operand types. The instructions are the VM's own copy, shared by every
+// call of the function in this VM, and the rewrite is undone by the specialized instruction when it sees other operands
+func (vm *VM) quicken(ins code.Instructions, ip int) {
+	if _, _, ok := vm.integerOperands(); !ok {
+		return
+	}
+	if specialized, ok := code.IntegerOpcode(code.Opcode(ins[ip])); ok {
+		ins[ip] = byte(specialized)
+	}
+}
+
+// generalize : rewrite the integer specialization at ip back to its generic instruction, and return the latter
+func generalize(ins code.Instructions, ip int) code.Opcode {
+	generic, _ := code.GenericOpcode(code.Opcode(ins[ip]))
+	ins[ip] = byte(generic)
+	return generic
+}
+
+// executeQuickOperation : run the arithmetic integer specialization at ip, falling back to the generic operation when
+// an operand is not an integer. The result replaces the operands on the stack, which needs no room
+func (vm *VM) executeQuickOperation(ins code.Instructions, ip int) error {
+	left, right, ok := vm.integerOperands()
+	if !ok {
+		return vm.executeBinaryOperation(generalize(ins, ip))
+	}
+
+	var result int64
+
+	switch code.Opcode(ins[ip]) {
+	case code.OpAddInt:
+		result = left + right
+	case code.OpSubInt:
+		result = left - right
+	case code.OpMulInt:
+		result = left * right
+	case code.OpDivInt:
+		if right == 0 {
+			vm.sp -= 2
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
+		result = left / right
+	case code.OpModInt:
+		if right == 0 {
+			vm.sp -= 2
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
+		result = left % right
+	}
+
+	vm.sp--
+	vm.stack[vm.sp-1] = &object.Integer{Value: result}
+	return nil
+}
+
+// executeQuickComparison : run the comparison integer specialization at ip, falling back to the generic comparison
+// when an operand is not an integer
+func (vm *VM) executeQuickComparison(ins code.Instructions, ip int) error {
+	left, right, ok := vm.integerOperands()
+	if !ok {
+		return vm.executeComparison(generalize(ins, ip))
+	}
+
+	var result bool
+
+	switch code.Opcode(ins[ip]) {
+	case code.OpEqualInt:
+		result = left == right
+	case code.OpNotEqualInt:
+		result = left != right
+	case code.OpGreaterThanInt:
+		result = left > right
+	case code.OpLessThanInt:
+		result = left < right
+	case code.OpGreaterEqualInt:
+		result = left >= right
+	case code.OpLessEqualInt:
+		result = left <= right
+	}
+
+	vm.sp--
+	vm.stack[vm.sp-1] = nativeBoolToBooleanObject(result)
+	return nil
+}
+
+// executeFusedOperation : push the sum or the difference of a local and a constant, as OpGetLocalAddConstant or
+// OpGetLocalSubConstant, without going through the stack when both are integers
+func (vm *VM) executeFusedOperation(op code.Opcode, left, right object.Object) error {
+	generic := code.OpAdd
+	if op == code.OpGetLocalSubConstant {
+		generic = code.OpSub
+	}
+
+	leftInt, ok := left.(*object.Integer)
+	rightInt, ok2 := right.(*object.Integer)
+	if !ok || !ok2 {
+		err := vm.push(left)
+		if err != nil {
+			return err
+		}
+		err = vm.push(right)
+		if err != nil {
+			return err
+		}
+		return vm.executeBinaryOperation(generic)
+	}
+
+	if generic == code.OpAdd {
+		return vm.push(&object.Integer{Value: leftInt.Value + rightInt.Value})
+	}
+	return vm.push(&object.Integer{Value: leftInt.Value - rightInt.Value})
+}
+
+// executeFusedComparison : pop the operands of the comparison op and return whether it holds, for
+// OpCompareJumpNotTruthy
+func (vm *VM) executeFusedComparison(op code.Opcode) (bool, error) {
+	left, right, ok := vm.integerOperands()
+	if !ok {
+		err := vm.executeComparison(op)
+		if err != nil {
+			return false, err
+		}
+		return isTruthy(vm.pop()), nil
+	}
+	vm.sp -= 2
+
+	switch op {
+	case code.OpEqual:
+		return left == right, nil
+	case code.OpNotEqual:
+		return left != right, nil
+	case code.OpGreaterThan:
+		return left > right, nil
+	case code.OpLessThan:
+		return left < right, nil
+	case code.OpGreaterEqual:
+		return left >= right, nil
+	case code.OpLessEqual:
+		return left <= right, nil
+	default:
+		return false, newError(object.TYPE_ERROR, "unknown operator: %d", op)
+	}
+}
+
 func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
@@ -322,10 +907,12 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right):
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 	default:
-		return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+		return newError(object.TYPE_ERROR, "unsupported types for binary operation: %s %s", leftType, rightType)
 	}
 }
 
@@ -343,17 +930,51 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
 		result = leftValue / rightValue
+	case code.OpMod:
+		if rightValue == 0 {
+			return newError(object.ZERO_DIVISION_ERROR, "division by zero")
+		}
+		result = leftValue % rightValue
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return newError(object.TYPE_ERROR, "unknown integer operator: %d", op)
 	}
 
 	return vm.push(&object.Integer{Value: result})
 }
 
+// executeBinaryFloatOperation : operation between two numbers, at least one of which is a float. Integers are
+// converted to floats
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var result float64
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		result = leftValue / rightValue
+	case code.OpMod:
+		result = math.Mod(leftValue, rightValue)
+	default:
+		return newError(object.TYPE_ERROR, "unknown float operator: %d", op)
+	}
+
+	return vm.push(&object.Float{Value: result})
+}
+
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return newError(object.TYPE_ERROR, "unknown string operator: %d", op)
 	}
 
 	leftValue := left.(*object.String).Value
@@ -369,14 +990,17 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
 
 	switch op {
 	case code.OpEqual:
-		return vm.push(nativeBoolToBooleanObject(right == left))
+		return vm.push(nativeBoolToBooleanObject(object.Equal(left, right)))
 	case code.OpNotEqual:
-		return vm.push(nativeBoolToBooleanObject(right != left))
+		return vm.push(nativeBoolToBooleanObject(!object.Equal(left, right)))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)", op, left.Type(), right.Type())
+		return newError(object.TYPE_ERROR, "unknown operator: %d (%s %s)", op, left.Type(), right.Type())
 	}
 }
 
@@ -391,8 +1015,51 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return newError(object.TYPE_ERROR, "unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeFloatComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return newError(object.TYPE_ERROR, "unknown operator: %d", op)
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
 	}
 }
 
@@ -414,22 +1081,58 @@ func (vm *VM) executeBangOperator() error {
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(&object.Integer{Value: -operand.Value})
+	case *object.Float:
+		return vm.push(&object.Float{Value: -operand.Value})
+	default:
+		return newError(object.TYPE_ERROR, "unsupported type for negation: %s", operand.Type())
 	}
+}
 
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
+// executeIndexAssignment : set the element of an array or the value of a hash key, pushing the assigned value
+func (vm *VM) executeIndexAssignment(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		idx, ok := index.(*object.Integer)
+		if !ok {
+			return newError(object.TYPE_ERROR, "array index must be INTEGER, got %s", index.Type())
+		}
+		if idx.Value < 0 || idx.Value >= int64(len(left.Elements)) {
+			return newError(object.INDEX_ERROR, "index out of range: %d", idx.Value)
+		}
+
+		left.Elements[idx.Value] = value
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+	default:
+		return newError(object.TYPE_ERROR, "index assignment not supported: %s", left.Type())
+	}
+
+	return vm.push(value)
 }
 
 func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeStringIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
+	case left.Type() == object.ERROR_OBJ:
+		if field, ok := left.(*object.Error).Field(index); ok {
+			return vm.push(field)
+		}
+		return vm.push(Null)
 	default:
-		return fmt.Errorf("index operator not supported: %s", left.Type())
+		return newError(object.TYPE_ERROR, "index operator not supported: %s", left.Type())
 	}
 }
 
@@ -445,12 +1148,25 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	return vm.push(arrayObject.Elements[i])
 }
 
+// executeStringIndex : push the character at index as a string. Strings are indexed by character, not by byte
+func (vm *VM) executeStringIndex(str, index object.Object) error {
+	chars := []rune(str.(*object.String).Value)
+	i := index.(*object.Integer).Value
+	max := int64(len(chars) - 1)
+
+	if i < 0 || i > max {
+		return vm.push(Null)
+	}
+
+	return vm.push(&object.String{Value: string(chars[i])})
+}
+
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	hashObject := hash.(*object.Hash)
 
 	key, ok := index.(object.Hashable)
 	if !ok {
-		return fmt.Errorf("unusable as hash key: %s", index.Type())
+		return newError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
 	}
 
 	pair, ok := hashObject.Pairs[key.HashKey()]
@@ -482,7 +1198,7 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			return nil, newError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
 		}
 
 		hashedPairs[hashKey.HashKey()] = pair
@@ -495,7 +1211,7 @@ func (vm *VM) pushClosure(constIndex, numFree int) error {
 	constant := vm.constants[constIndex]
 	function, ok := constant.(*object.CompiledFunction)
 	if !ok {
-		return fmt.Errorf("not a function: %+v", constant)
+		return newError(object.RUNTIME_ERROR, "not a function: %+v", constant)
 	}
 
 	free := make([]object.Object, numFree)
@@ -504,7 +1220,7 @@ func (vm *VM) pushClosure(constIndex, numFree int) error {
 	}
 	vm.sp -= numFree
 
-	closure := &object.Closure{Fn: function, Free: free}
+	closure := &object.Closure{Fn: function, Free: free, Unit: vm.unit}
 	return vm.push(closure)
 }
 
@@ -516,19 +1232,111 @@ func (vm *VM) executeCall(numArgs int) error {
 	case *object.Builtin:
 		return vm.callBuiltin(callee, numArgs)
 	default:
-		return fmt.Errorf("calling non-function and no-builtin")
+		return newError(object.TYPE_ERROR, "calling non-function and no-builtin")
+	}
+}
+
+// executeTailCall : call a closure in place of the current frame, moving the callee and its arguments over the slot of
+// the current callee, so that recursion in tail position runs in constant frame and stack space. Builtins are called
+// normally, the current function then returns their result
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		return vm.executeCall(numArgs)
+	}
+
+	// check the arguments before the current frame is gone, for the error to point at the call
+	if arity := cl.Fn.Arity(); !arity.Accepts(numArgs) {
+		return object.NewArityError(cl.Fn.Name, arity, numArgs)
 	}
+
+	frame := vm.popFrame()
+	base := frame.basePointer - 1
+	copy(vm.stack[base:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	vm.sp = base + 1 + numArgs
+
+	return vm.callClosure(cl, numArgs)
 }
 
+// importModule : run a module the first time it is imported, in a VM of its own sharing the modules already run, and
+// return the hash of its exported bindings
+func (vm *VM) importModule(mod *object.CompiledModule) (*object.Hash, error) {
+	if namespace, ok := vm.modules[mod.Name]; ok {
+		return namespace, nil
+	}
+
+	bytecode := &compiler.Bytecode{
+		Instructions: mod.Instructions,
+		SourceMap:    mod.SourceMap,
+		Constants:    mod.Constants,
+	}
+	machine := NewWithOptions(bytecode, vm.options)
+	machine.modules = vm.modules
+
+	err := machine.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	exports := make(map[string]object.Object, len(mod.Exports))
+	for name, index := range mod.Exports {
+		exports[name] = machine.getGlobal(index)
+	}
+
+	namespace := module.Namespace(exports)
+	vm.modules[mod.Name] = namespace
+	return namespace, nil
+}
+
+// unwrapCell : return the value of a variable, which is held in a cell once captured by a closure
+func unwrapCell(obj object.Object) object.Object {
+	if cell, ok := obj.(*object.Cell); ok {
+		return cell.Value
+	}
+	return obj
+}
+
+// callClosure : push the frame of a call to cl with the numArgs arguments on top of the stack. The slots of the
+// missing arguments stay empty for the prologue of the function to fill with their defaults, and the extra arguments of
+// a variadic function are collected into an array in the slot after the parameters
 func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
-	if numArgs != cl.Fn.NumParameters {
-		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	fn := cl.Fn
+	if arity := fn.Arity(); !arity.Accepts(numArgs) {
+		return object.NewArityError(fn.Name, arity, numArgs)
+	}
+
+	var rest *object.Array
+	if fn.Variadic {
+		extra := 0
+		if numArgs > fn.NumParameters {
+			extra = numArgs - fn.NumParameters
+		}
+
+		rest = &object.Array{Elements: make([]object.Object, extra)}
+		copy(rest.Elements, vm.stack[vm.sp-extra:vm.sp])
+		vm.sp -= extra
+		numArgs -= extra
 	}
 
 	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	err := vm.ensureStack(frame.basePointer + fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	err = vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
+
+	// the slots of the locals may still hold cells of a previous call, which must not be shared with this one
+	for i := vm.sp; i < frame.basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
+	if rest != nil {
+		vm.stack[frame.basePointer+fn.NumParameters] = rest
+	}
 
-	vm.sp = frame.basePointer + cl.Fn.NumLocals
+	vm.sp = frame.basePointer + fn.NumLocals
 
 	return nil
 }
@@ -537,6 +1345,9 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 
 	result := builtin.Fn(args...)
+	if ex, ok := result.(*object.Exception); ok {
+		return ex.Error
+	}
 	vm.sp = vm.sp - numArgs - 1
 
 	if result != nil {
@@ -548,6 +1359,13 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	return nil
 }
 
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -1,12 +1,20 @@
 package vm
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"monkey/ast"
+	"monkey/code"
 	"monkey/compiler"
+	"monkey/frontend"
 	"monkey/lexer"
+	"monkey/module"
 	"monkey/object"
 	"monkey/parser"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -33,6 +41,32 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"10 - 3 % 2 * 4", 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"2.5", 2.5},
+		{"-2.5", -2.5},
+		{"1.5 + 1.5", 3.0},
+		{"1 + 0.5", 1.5},
+		{"0.5 + 1", 1.5},
+		{"3 - 0.5 * 2", 2.0},
+		{"7 / 2.0", 3.5},
+		{"2.5e2 * -2", -500.0},
+		{"1.5 > 1", true},
+		{"1 > 1.5", false},
+		{"1.0 == 1", true},
+		{"1 != 1.0", false},
+		{"7.5 % 2", 1.5},
+		{"-7 % 2.5", -2.0},
+		{"1.5 <= 1.5", true},
+		{"1 >= 1.5", false},
 	}
 
 	runVmTests(t, tests)
@@ -46,6 +80,10 @@ func TestBooleanExpression(t *testing.T) {
 		{"1 > 2", false},
 		{"1 < 1", false},
 		{"1 > 1", false},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
 		{"1 == 1", true},
 		{"1 != 1", false},
 		{"1 == 2", false},
@@ -71,6 +109,35 @@ func TestBooleanExpression(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestComparisonEvaluationOrder(t *testing.T) {
+	tests := []vmTestCase{
+		{"let log = []; let f = fn(x) { log = push(log, x); x }; f(1) < f(2); log", []int{1, 2}},
+		{"let log = []; let f = fn(x) { log = push(log, x); x }; f(2) >= f(1); f(3) <= f(4); f(5) > f(6); log", []int{2, 1, 3, 4, 5, 6}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || 1", true},
+		{"1 && 0", true},
+		{"false && (1 + true)", false},
+		{"true || (1 + true)", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		{"let x = 0; let f = fn() { x = 1; true }; false && f(); x", 0},
+		{"let x = 0; let f = fn() { x = 1; true }; true || f(); x", 0},
+		{"let x = 0; let f = fn() { x = 1; true }; true && f(); x", 1},
+		{"if (1 > 2 || 2 > 1) { 10 } else { 20 }", 10},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", 10},
@@ -88,6 +155,130 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"while (true) { break; }; 1", 1},
+		{"while (false) { 1 / 0 }; 2", 2},
+		{"let f = fn() { while (true) { return 5; } }; f()", 5},
+		{"for (x in [1, 2, 3]) { }; x", 3},
+		{"for (x in [1, 2, 3]) { if (x == 2) { break; } }; x", 2},
+		{"let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } }; -1 }; f([1, 5, 2])", 5},
+		{"let f = fn(arr) { for (x in arr) { if (x > 2) { return x; } }; -1 }; f([1, 2])", -1},
+		{"let f = fn() { for (x in [1, 2, 3, 4]) { if (x < 3) { continue; } return x; } }; f()", 3},
+		{
+			`let f = fn() {
+				for (x in [1, 2, 3]) {
+					for (y in [10, 20]) {
+						if (y > 10) { break; }
+						if (x < 3) { continue; }
+						return x * y;
+					}
+				}
+			};
+			f()`,
+			30,
+		},
+		{`for (k in {"b": 1, "a": 2, "c": 3}) { break; }; k`, "a"},
+		{`for (c in "hé") { }; c`, "é"},
+		{"for (x in []) { }; 7", 7},
+		{"let f = fn() { for (x in [1]) { x } }; f()", Null},
+		{"if (true) { let y = 1; }", Null},
+		{"if (true) { }", Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+// TestLoopJumpsInExpressions : a break or continue inside an expression drops the operands the expression already
+// pushed. Each loop runs more iterations than the stack has slots
+func TestLoopJumpsInExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			"let i = 0; let s = 0; while (i < 5000) { i = i + 1; s = s + if (i % 2 == 0) { continue; } else { 1 }; }; s",
+			2500,
+		},
+		{
+			`let f = fn(c) {
+				let i = 0;
+				let n = 0;
+				while (i < 5000) {
+					i = i + 1;
+					let a = [1, 2, if (c(i)) { continue; }];
+					n = n + len(a);
+				}
+				n
+			};
+			f(fn(i) { i % 2 == 0 })`,
+			7500,
+		},
+		{"let i = 0; let s = 0; while (true) { i = i + 1; s = s + if (i == 3000) { break; } else { i }; }; s", 4498500},
+		{
+			`let a = [];
+			let i = 0;
+			while (i < 3000) { a = push(a, i); i = i + 1; }
+			let n = 0;
+			for (x in a) { n = n + [x, if (x % 3 == 0) { continue; } else { 1 }][1]; }
+			n`,
+			2000,
+		},
+		{"let i = 0; while (i < 3000) { i = i + 1; try { 1 } finally { continue; } }; i", 3000},
+		{
+			"let g = fn(a, b) { a }; let f = fn() { let i = 0; while (true) { i = i + 1; g(i, if (i > 3000) { break; }); } i }; f()",
+			3001,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let x = 1; let f = fn() { x = 5 }; f(); x", 5},
+		{"let f = fn(n) { n = n * 2; n }; f(4)", 8},
+		{"let f = fn() { let x = 1; let g = fn() { x = x + 10 }; g(); x }; f()", 11},
+		{"let counter = fn() { let c = 0; fn() { c = c + 1; c } }; let next = counter(); next(); next(); next()", 3},
+		{"let mk = fn() { let c = 0; fn() { c = c + 1 } }; let a = mk(); let b = mk(); a(); a(); b()", 1},
+		{"let f = fn() { let x = 0; let g = fn() { let h = fn() { x = x + 1 }; h(); h() }; g(); x }; f()", 2},
+		{"let f = fn() { let g = fn() { 1 }; let h = fn() { g = fn() { 2 } }; h(); g() }; f()", 2},
+		{"let f = fn() { let g = fn() { g = 5; 1 }; g(); g }; f()", 5},
+		{"let arr = [1, 2, 3]; arr[1] = 20; arr[1]", 20},
+		{"let arr = [1, 2, 3]; let alias = arr; alias[0] = 9; arr[0]", 9},
+		{`let h = {"a": 1}; h["b"] = 2; h["a"] + h["b"]`, 3},
+		{"let h = {}; h[1] = 2", 2},
+		{"let i = 0; let sum = 0; while (i < 5) { sum = sum + i; i = i + 1 }; sum", 10},
+		{"let f = fn() { let i = 0; while (i < 3) { i = i + 1 }; i }; f()", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"try { 1 } catch (e) { 2 }", 1},
+		{"try { 1 / 0 } catch (e) { 2 }", 2},
+		{"try { throw \"x\"; 1 } catch { 2 }", 2},
+		{"let x = 0; try { x = 1 } finally { x = x + 10 }; x", 11},
+		{"let x = 0; try { try { 1 / 0 } finally { x = 5 } } catch (e) { x + 1 }", 6},
+		{"let f = fn() { try { return 1 } finally { 2 } }; f()", 1},
+		{"let f = fn() { try { return 1 } finally { return 2 } }; f()", 2},
+		{"let g = fn() { throw \"deep\" }; let f = fn() { g() + 1 }; try { f() } catch (e) { 7 }", 7},
+		{"let f = fn() { let a = 1; try { let b = 2; throw \"x\" } catch (e) { a + 10 } }; f()", 11},
+		{"let n = 0; for (i in [1, 2, 3]) { try { if (i == 2) { break } } finally { n = n + 1 } }; n", 2},
+		{"let n = 0; for (i in [1, 2, 3]) { try { continue } finally { n = n + i } }; n", 6},
+		{"let f = fn() { try { 1 } catch (e) { 2 } }; try { f(); throw \"later\" } catch (e) { 3 }", 3},
+		{`try { "a" - "b" } catch (e) { e["type"] }`, object.TYPE_ERROR},
+		{`try { 1 % 0 } catch (e) { e["message"] }`, "division by zero"},
+		{`try { throw 1 } catch (e) { e["message"] }`, "cannot throw INTEGER, only ERROR or STRING"},
+		{`try { try { throw "in" } catch (e) { throw e } } catch (e2) { e2["message"] }`, "in"},
+		{`let e = try { first(1) } catch (err) { err }; e["missing"]`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
@@ -108,6 +299,15 @@ func TestStringExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestUnicodeIdentifiers(t *testing.T) {
+	tests := []vmTestCase{
+		{`let größe = 3; let 数 = 4; let x2 = größe * 数; x2`, 12},
+		{`let grüß = fn(名前) { "hallo " + 名前 }; grüß("welt")`, "hallo welt"},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestArrayLiterals(t *testing.T) {
 	tests := []vmTestCase{
 		{"[]", []int{}},
@@ -130,6 +330,11 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`"monkey"[0]`, "m"},
+		{`"héllo"[1]`, "é"},
+		{`"日本語"[2]`, "語"},
+		{`"monkey"[6]`, Null},
+		{`"monkey"[-1]`, Null},
 	}
 
 	runVmTests(t, tests)
@@ -364,15 +569,31 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
 			`fn() { 1; }(1);`,
-			`wrong number of arguments: want=0, got=1`,
+			`1:12: wrong number of arguments to anonymous function: want=0, got=1`,
 		},
 		{
 			`fn(a) { a; }();`,
-			`wrong number of arguments: want=1, got=0`,
+			`1:13: wrong number of arguments to anonymous function: want=1, got=0`,
 		},
 		{
 			`fn(a, b) { a + b; }(1);`,
-			`wrong number of arguments: want=2, got=1`,
+			`1:20: wrong number of arguments to anonymous function: want=2, got=1`,
+		},
+		{
+			"let add = fn(a, b) { a + b; };\nadd(1, 2, 3);",
+			`2:4: wrong number of arguments to add: want=2, got=3`,
+		},
+		{
+			`let f = fn(a, b = 2, c = 3) { a; }; f();`,
+			`1:38: wrong number of arguments to f: want=1 to 3, got=0`,
+		},
+		{
+			`let f = fn(a, b = 2) { a; }; f(1, 2, 3);`,
+			`1:31: wrong number of arguments to f: want=1 to 2, got=3`,
+		},
+		{
+			`let f = fn(a, b, ...rest) { a; }; f(1);`,
+			`1:36: wrong number of arguments to f: want=at least 2, got=1`,
 		},
 	}
 
@@ -397,24 +618,152 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestDefaultAndRestParameters(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn(a, b = 2) { a + b }; f(1)`, 3},
+		{`let f = fn(a, b = 2) { a + b }; f(1, 5)`, 6},
+		{`let f = fn(a, b = a * 10, c = a + b) { [a, b, c] }; f(1)`, []int{1, 10, 11}},
+		{`let f = fn(a, b = a * 10, c = a + b) { [a, b, c] }; f(1, 2)`, []int{1, 2, 3}},
+		{`let f = fn(a = []) { push(a, 1) }; f(); f()`, []int{1}},
+		{`let n = 0; let f = fn(a = n) { a }; n = 5; f()`, 5},
+		{`let f = fn(...rest) { rest }; f()`, []int{}},
+		{`let f = fn(a, ...rest) { rest }; f(1, 2, 3)`, []int{2, 3}},
+		{`let f = fn(a, b = 2, ...rest) { [a, b, len(rest)] }; f(1)`, []int{1, 2, 0}},
+		{`let f = fn(a, b = 2, ...rest) { [a, b, len(rest)] }; f(1, 5, 6, 7)`, []int{1, 5, 2}},
+		{
+			`let counter = fn(start = 0) { fn() { start = start + 1 } };
+			 let c = counter(); c(); c()`,
+			2,
+		},
+		{
+			`let f = fn(a, g = fn() { a }) { a = a + 1; g() }; f(1)`,
+			2,
+		},
+		{
+			`let f = fn(...rest) { fn() { rest } }; f(1, 2)()`,
+			[]int{1, 2},
+		},
+		{
+			`let sum = fn(first, ...others) { let total = first; for (x in others) { total = total + x }; total };
+			 sum(1, 2, 3, 4)`,
+			10,
+		},
+		{
+			`let f = fn(a = 1 / 0) { a }; try { f() } catch (e) { e }`,
+			&object.Error{Kind: object.ZERO_DIVISION_ERROR, Message: "division by zero"},
+		},
+		{
+			`let f = fn(a) { a }; try { f() } catch (e) { e }`,
+			&object.Error{Kind: object.ARGUMENT_ERROR, Message: "wrong number of arguments to f: want=1, got=0"},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLetPatterns(t *testing.T) {
+	tests := []vmTestCase{
+		{`let [a, b] = [1, 2]; a * 10 + b`, 12},
+		{`let [first, ...rest] = [1, 2, 3]; rest`, []int{2, 3}},
+		{`let [...all] = []; all`, []int{}},
+		{`let [a, [b, c]] = [1, [2, 3]]; [c, b, a]`, []int{3, 2, 1}},
+		{`let a = 1; let b = 2; let [a, b] = [b, a]; [a, b]`, []int{2, 1}},
+		{`let {x, y} = {"x": 1, "y": 2, "z": 3}; [x, y]`, []int{1, 2}},
+		{`let {point: {x: px}, tags: [t, ...ts]} = {"point": {"x": 5}, "tags": [1, 2]}; [px, t, len(ts)]`, []int{5, 1, 1}},
+		{`let {type} = try { 1 / 0 } catch (e) { e }; type`, "ZeroDivisionError"},
+		{
+			`let f = fn(pair) { let [a, b] = pair; let g = fn() { a + b }; a = 10; g() }; f([1, 2])`,
+			12,
+		},
+		{
+			`let sum = 0; for (pair in [[1, 2], [3, 4]]) { let [a, b] = pair; sum = sum + a * b }; sum`,
+			14,
+		},
+		{
+			`try { let [a, b] = [1]; a } catch (e) { e }`,
+			&object.Error{Kind: object.PATTERN_ERROR, Message: "wrong number of elements to destructure: want=2, got=1"},
+		},
+		{
+			`try { let [a, ...b] = []; a } catch (e) { e }`,
+			&object.Error{Kind: object.PATTERN_ERROR, Message: "wrong number of elements to destructure: want=at least 1, got=0"},
+		},
+		{
+			`try { let [a] = "a"; a } catch (e) { e }`,
+			&object.Error{Kind: object.PATTERN_ERROR, Message: "cannot destructure STRING with an array pattern"},
+		},
+		{
+			`try { let {a} = [1]; a } catch (e) { e }`,
+			&object.Error{Kind: object.PATTERN_ERROR, Message: "cannot destructure ARRAY with a hash pattern"},
+		},
+		{
+			`try { let {a, b} = {"a": 1}; a } catch (e) { e }`,
+			&object.Error{Kind: object.PATTERN_ERROR, Message: `cannot destructure missing key "b"`},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRuntimeErrorPositions(t *testing.T) {
+	tests := []vmTestCase{
+		{`1 + true`, `1:3: unsupported types for binary operation: INTEGER BOOLEAN`},
+		{
+			"let negate = fn(x) {\n  -x\n};\nnegate(\"a\")",
+			`2:3: unsupported type for negation: STRING`,
+		},
+		{"for (x in 5) { }", `1:11: cannot iterate over INTEGER`},
+		{"let x = 0;\n1 / x", `2:3: division by zero`},
+		{"5 % 0", `1:3: division by zero`},
+		{"let a = [1];\na[1] = 2", `2:2: index out of range: 1`},
+		{"let s = \"ab\";\ns[0] = \"c\"", `2:2: index assignment not supported: STRING`},
+		{"let f = fn() {\n  throw \"boom\"\n};\nf()", `2:3: boom`},
+		{"let [a, [b]] =\n  [1, 2]", `1:9: cannot destructure INTEGER with an array pattern`},
+		{"let f = fn(a) { a };\nlet g = fn() {\n  f(1, 2)\n};\ng()", `3:4: wrong number of arguments to f: want=1, got=2`},
+		{"try {\n  1 / 0\n} catch (e) {\n  throw e\n}", `2:5: division by zero`},
+		{"let f = fn(n) {\n  1 + f(n + 1)\n};\nf(0)", `2:3: stack overflow`},
+		{"try { 1 } finally {\n  len(1)\n}", "2:6: argument to `len` not supported, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none.")
+		}
+
+		if err.Error() != tt.expected {
+			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
 		{`len("four")`, 4},
+		{`len("a\tb\"")`, 4},
+		{`len("héllo wörld")`, 11},
+		{`len("日本語")`, 3},
 		{`len("hello world!")`, 12},
 		{
-			`
-				len(1)
-			`,
+			`try { len(1) } catch (e) { e }`,
 			&object.Error{
+				Kind:    object.TYPE_ERROR,
 				Message: "argument to `len` not supported, got INTEGER",
 			},
 		},
 		{
-			`
-				len("one", "two")
-			`,
+			`try { len("one", "two") } catch (e) { e }`,
 			&object.Error{
+				Kind:    object.ARGUMENT_ERROR,
 				Message: "wrong number of arguments. got=2, want=1",
 			},
 		},
@@ -424,20 +773,18 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, Null},
 		{
-			`
-				first(1)
-			`,
+			`try { first(1) } catch (e) { e }`,
 			&object.Error{
+				Kind:    object.TYPE_ERROR,
 				Message: "argument to `first` must be ARRAY, got INTEGER",
 			},
 		},
 		{`last([1, 2, 3])`, 3},
 		{`last([])`, Null},
 		{
-			`
-				last(1)
-			`,
+			`try { last(1) } catch (e) { e }`,
 			&object.Error{
+				Kind:    object.TYPE_ERROR,
 				Message: "argument to `last` must be ARRAY, got INTEGER",
 			},
 		},
@@ -445,13 +792,30 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`rest([])`, Null},
 		{`push([], 1)`, []int{1}},
 		{
-			`
-				push(1, 1)
-			`,
+			`try { push(1, 1) } catch (e) { e }`,
 			&object.Error{
+				Kind:    object.TYPE_ERROR,
 				Message: "argument to `push` must be ARRAY, got INTEGER",
 			},
 		},
+		{
+			`arity(fn(a, b = 1, ...rest) { a })`,
+			map[object.HashKey]int64{
+				(&object.String{Value: "min"}).HashKey(): 1,
+				(&object.String{Value: "max"}).HashKey(): -1,
+			},
+		},
+		{
+			`arity(fn(a, b = 1) { a })["max"]`,
+			2,
+		},
+		{
+			`try { arity(len) } catch (e) { e }`,
+			&object.Error{
+				Kind:    object.TYPE_ERROR,
+				Message: "argument to `arity` must be a user defined function, got BUILTIN",
+			},
+		},
 	}
 
 	runVmTests(t, tests)
@@ -588,6 +952,295 @@ func TestRecursiveFunctions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let sum = fn(n, acc) { if (n == 0) { acc } else { sum(n - 1, acc + n) } }; sum(100000, 0)`,
+			5000050000,
+		},
+		{
+			`let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; sum(100000, 0)`,
+			5000050000,
+		},
+		{
+			`let odd = 0;
+			 let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } };
+			 odd = fn(n) { if (n == 0) { false } else { even(n - 1) } };
+			 even(50001) == false && odd(50001)`,
+			true,
+		},
+		{
+			`let count = fn(n, acc) { let get = fn() { acc }; if (n == 0) { get() } else { count(n - 1, acc + 1) } };
+			 count(10000, 0)`,
+			10000,
+		},
+		{
+			`let loop = fn(n, ...rest) { if (n == 0) { len(rest) } else { loop(n - 1, 1, 2) } }; loop(5000)`,
+			2,
+		},
+		{
+			`let f = fn(n) { if (n == 0) { 1 / 0 } else { f(n - 1) } }; try { f(5000) } catch (e) { e["type"] }`,
+			"ZeroDivisionError",
+		},
+		{
+			`let g = fn(n) { if (n == 0) { throw "done" } else { g(n - 1) } };
+			 let f = fn(n) { try { g(n) } catch (e) { n } };
+			 f(3000)`,
+			3000,
+		},
+		{`let wrap = fn(a) { len(a) }; wrap([1, 2, 3]) + 1`, 4},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestOptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		options  Options
+		expected string
+	}{
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(300)", Options{}, ""},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Options{}, "stack overflow"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Options{StackSize: 65536}, ""},
+		{"let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(1000)", Options{MaxFrames: 100}, "stack overflow: more than 100 nested calls"},
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; f(1000)", Options{MaxFrames: 100}, ""},
+		{"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]", Options{StackSize: 10}, ""},
+		{"[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11]", Options{StackSize: 10}, "stack overflow"},
+		{"let f = fn() { let a = 1; let b = 2; a + b }; f()", Options{StackSize: 5}, ""},
+		{"let f = fn() { let a = 1; let b = 2; a + b }; f()", Options{StackSize: 4}, "stack overflow"},
+		{"let f = fn(n) { 1 + f(n + 1) }; try { f(0) } catch (e) { e[\"type\"] }", Options{MaxFrames: 10}, ""},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), tt.options)
+		err = vm.Run()
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("vm error for %q: %s", tt.input, err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("expected a VM error for %q but resulted in none.", tt.input)
+			continue
+		}
+		errObj, ok := err.(*object.Error)
+		if !ok || errObj.Kind != object.RUNTIME_ERROR || errObj.Message != tt.expected {
+			t.Errorf("wrong VM error for %q. want=%q, got=%#v", tt.input, tt.expected, err)
+		}
+	}
+
+	defaults := Options{}.withDefaults()
+	if defaults.StackSize != 2048 || defaults.MaxFrames != 1024 {
+		t.Errorf("wrong default limits. want=2048 values and 1024 calls, got=%+v", defaults)
+	}
+}
+
+func TestOptimizedResults(t *testing.T) {
+	tests := []string{
+		"let f = fn(x) { if (!x) { let y = 1; } else { x } }; [f(true), f(false)]",
+		"let f = fn(x) { if (x) { let y = 1; } }; [f(true), f(false)]",
+		"if (1 > 2) { let y = 1; }",
+		"let x = 5; if (x > 2) { let y = 1; }",
+		"let f = fn(a, b) { if (a && !b) { 1 } else { if (a || b) { 2 } else { 3 } } }; [f(true, false), f(false, true), f(false, false)]",
+		"let f = fn(n) { let i = 0; let s = 0; while (i < n) { i = i + 1; if (i % 2 == 0) { continue; } if (i > 7) { break; } s = s + i; } s }; f(20)",
+		"let f = fn(a) { let s = 0; for (x in a) { if (!(x > 2)) { s = s + x; } } s }; f([1, 2, 3, 4])",
+		"let f = fn(x) { if (x) { return 1; } else { return 2; } 3 }; [f(true), f(false)]",
+		"let f = fn(x) { try { if (x) { throw \"a\" } 1 } catch (e) { 2 } finally { 3 } }; [f(true), f(false)]",
+		"let f = fn() { let i = 0; while (true) { try { i = i + 1; if (i == 3) { break; } } finally { i = i * 2 } } i }; f()",
+		"let f = fn(a = !true) { if (!a) { \"no\" } else { \"yes\" } }; [f(), f(1)]",
+		"let f = fn(x) { if (x) { 1 / 0 } }; f(true)",
+		"let f = fn(x) { if (!x) { len(1) } }; f(false)",
+		"let f = fn(x) { [x + 1, x - 1] }; [f(1), f(1.5)]",
+		"let f = fn(x) { x + \"b\" }; f(\"a\")",
+		"let f = fn(x) { x - 1 }; f(\"a\")",
+		"let f = fn(a, b) { if (a < b) { 1 } else { 2 } }; [f(1, 2), f(2.5, 1), f(1, 1.5)]",
+		"let f = fn(a, b) { if (a == b) { 1 } else { 2 } }; [f(\"a\", \"a\"), f([1], [2]), f(1, 1), f(true, 1)]",
+		"let f = fn(a, b) { if (a < b) { 1 } }; f(\"a\", \"b\")",
+		"let f = fn() { 1 }; let g = fn(a) { a }; let h = fn(a, b) { a + b }; [f(), g(2), h(1, 2), len([1])]",
+		"let f = fn(a) { a }; f()",
+		"let f = fn(n) { if (n < 2) { return n; } f(n - 1) + f(n - 2) }; f(15)",
+	}
+
+	for _, input := range tests {
+		optimized, optimizedErr := runOptimized(t, input, true)
+		unoptimized, unoptimizedErr := runOptimized(t, input, false)
+
+		if fmt.Sprint(optimizedErr) != fmt.Sprint(unoptimizedErr) {
+			t.Errorf("different errors for %q. optimized=%v, unoptimized=%v", input, optimizedErr, unoptimizedErr)
+		}
+		if optimizedErr == nil && optimized.Inspect() != unoptimized.Inspect() {
+			t.Errorf("different results for %q. optimized=%s, unoptimized=%s", input, optimized.Inspect(), unoptimized.Inspect())
+		}
+	}
+}
+
+// runOptimized : run input compiled with or without the optimizations, returning the last popped value or the error
+func runOptimized(t *testing.T, input string, optimize bool) (object.Object, error) {
+	t.Helper()
+
+	comp := compiler.New()
+	comp.SetOptimize(optimize)
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+	return vm.LastPoppedStackElem(), err
+}
+
+func TestGlobalsAllocatedLazily(t *testing.T) {
+	program := parse("let a = 1; let b = 2; let c = fn() { b = a + b; b }; c(); c()")
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	if len(vm.globals) != 0 {
+		t.Errorf("globals allocated before the run. got=%d", len(vm.globals))
+	}
+
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 4, vm.LastPoppedStackElem())
+	if len(vm.globals) < 3 || len(vm.globals) >= GlobalsSize {
+		t.Errorf("wrong number of globals allocated. got=%d", len(vm.globals))
+	}
+}
+
+func TestQuickening(t *testing.T) {
+	f := "let f = fn(a, b) { if (a < b) { a * b } else { a - b } }; "
+	tests := []struct {
+		input    string
+		expected interface{}
+		opcodes  []code.Opcode
+	}{
+		{f + "f(2, 3)", 6, []code.Opcode{code.OpLessThanInt, code.OpMulInt, code.OpSub}},
+		{f + "f(2, 3); f(3, 2)", 1, []code.Opcode{code.OpLessThanInt, code.OpMulInt, code.OpSubInt}},
+		{f + "f(2, 3); f(2.5, 1)", 1.5, []code.Opcode{code.OpLessThan, code.OpMulInt, code.OpSub}},
+		{f + "f(2.5, 1); f(2, 3)", 6, []code.Opcode{code.OpLessThanInt, code.OpMulInt, code.OpSub}},
+		{"let g = fn(a, b) { a + b }; g(1, 2); g(\"a\", \"b\")", "ab", []code.Opcode{code.OpAdd}},
+		{"let g = fn(a, b) { a == b }; g(1, 1); g(true, true)", true, []code.Opcode{code.OpEqual}},
+		{"let g = fn(a, b) { a / b }; g(4, 2); g(1, 0)", &object.Error{Kind: object.ZERO_DIVISION_ERROR,
+			Message: "division by zero"}, []code.Opcode{code.OpDivInt}},
+		{"let g = fn(a, b) { a % b }; g(4, 2); g(1, \"a\")", &object.Error{Kind: object.TYPE_ERROR,
+			Message: "unsupported types for binary operation: INTEGER STRING"}, []code.Opcode{code.OpMod}},
+	}
+
+	for _, tt := range tests {
+		// superinstructions would replace the generic instructions
+		comp := compiler.New()
+		comp.SetOptimize(false)
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		bytecode := comp.Bytecode()
+		before, err := bytecode.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if expected, ok := tt.expected.(*object.Error); ok {
+			actual, ok := err.(*object.Error)
+			if !ok || actual.Kind != expected.Kind || actual.Message != expected.Message {
+				t.Errorf("wrong error for %q. want=%s, got=%v", tt.input, expected.Message, err)
+			}
+		} else {
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+		}
+
+		// the VM quickens its own copy of the instructions
+		after, err := bytecode.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %s", err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Errorf("bytecode modified by running %q", tt.input)
+		}
+
+		var fn *object.CompiledFunction
+		for _, constant := range vm.constants {
+			if constant, ok := constant.(*object.CompiledFunction); ok {
+				fn = constant
+			}
+		}
+
+		opcodes := map[code.Opcode]bool{}
+		for i := 0; i < len(fn.Instructions); {
+			def, err := code.Lookup(fn.Instructions[i])
+			if err != nil {
+				t.Fatalf("wrong instructions for %q: %s", tt.input, err)
+			}
+			opcodes[code.Opcode(fn.Instructions[i])] = true
+			_, read := code.ReadOperands(def, fn.Instructions[i+1:])
+			i += 1 + read
+		}
+		for _, op := range tt.opcodes {
+			if !opcodes[op] {
+				def, _ := code.Lookup(byte(op))
+				t.Errorf("%s missing after running %q. got=\n%s", def.Name, tt.input, fn.Instructions)
+			}
+		}
+	}
+}
+
+func TestSharedBytecode(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn(a, b) { if (a < b) { a * b } else { a - b } }; [f(2, 3), f(2.5, 1), f(3, 2)]"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	var wg sync.WaitGroup
+	results := make([]string, 8)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				vm := New(bytecode)
+				if err := vm.Run(); err != nil {
+					results[i] = err.Error()
+					return
+				}
+				results[i] = vm.LastPoppedStackElem().Inspect()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		if result != "[6, 1.5, 1]" {
+			t.Errorf("wrong result of VM %d. want=%q, got=%q", i, "[6, 1.5, 1]", result)
+		}
+	}
+}
+
 func TestRecursiveFibonacci(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -612,6 +1265,172 @@ func TestRecursiveFibonacci(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestRunningSerializedBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = "mon"; x + "key"`, "monkey"},
+		{
+			`
+				let newAdder = fn(a) { fn(b) { a + b } };
+				let addTwo = newAdder(2);
+				addTwo(40)
+			`,
+			42,
+		},
+		{`let f = fn(x) { if (x > 1) { f(x - 1) * x } else { 1 } }; f(5)`, 120},
+		{`let twice = macro(x) { quote(unquote(x) + unquote(x)) }; twice(21)`, 42},
+	}
+
+	for _, tt := range tests {
+		program, err := frontend.New().Process(parse(tt.input))
+		if err != nil {
+			t.Fatalf("macro expansion failed: %s", err)
+		}
+
+		comp := compiler.New()
+		err = comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		data, err := comp.Bytecode().MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %s", err)
+		}
+
+		bytecode := &compiler.Bytecode{}
+		err = bytecode.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("UnmarshalBinary failed: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
+func TestImports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monkey-vm")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"shapes.mk": "let pi = 3;\nexport let area = fn(r) { pi * r * r };\nexport let bad = fn() { -\"x\" };",
+		"broken.mk": "let x = 1;\nx / 0;",
+		"a.mk":      `let b = import "b";`,
+		"b.mk":      `let a = import "a";`,
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let s = import "shapes"; s["area"](2)`, 12},
+		{`let s = import "shapes"; let pi = 0; s["area"](1) + pi`, 3},
+		{`let s = import "shapes";` + "\n" + `s["bad"]()`, fmt.Sprintf("%s:3:25: unsupported type for negation: STRING", filepath.Join(dir, "shapes.mk"))},
+		{`import "broken"`, fmt.Sprintf("%s:2:3: division by zero", filepath.Join(dir, "broken.mk"))},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		comp.SetLoader(module.NewLoader([]string{dir}))
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		// modules are compiled into the bytecode, running it must not need the source files
+		data, err := comp.Bytecode().MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary failed: %s", err)
+		}
+
+		bytecode := &compiler.Bytecode{}
+		err = bytecode.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("UnmarshalBinary failed: %s", err)
+		}
+
+		vm := New(bytecode)
+		err = vm.Run()
+		if message, ok := tt.expected.(string); ok {
+			if err == nil || err.Error() != message {
+				t.Errorf("wrong VM error for %q: want=%q, got=%v", tt.input, message, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+
+	comp := compiler.New()
+	comp.SetLoader(module.NewLoader(nil))
+	err = comp.Compile(parse(fmt.Sprintf("import %q", filepath.Join(dir, "a"))))
+	a, b := filepath.Join(dir, "a.mk"), filepath.Join(dir, "b.mk")
+	expected := fmt.Sprintf("1:1: %s:1:9: %s:1:9: import cycle: %s -> %s -> %s", a, b, a, b, a)
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong compiler error: want=%q, got=%v", expected, err)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`
+			let unless = macro(cond, cons, alt) {
+				quote(if (!(unquote(cond))) { unquote(cons) } else { unquote(alt) });
+			};
+			unless(10 > 5, "not greater", "greater");
+			`,
+			"greater",
+		},
+		{
+			`
+			let double = macro(x) { quote(unquote(x) * 2) };
+			let f = fn(a) { double(a) + double(a + 1) };
+			f(3);
+			`,
+			14,
+		},
+	}
+
+	for _, tt := range tests {
+		program, err := frontend.New().Process(parse(tt.input))
+		if err != nil {
+			t.Fatalf("macro expansion failed: %s", err)
+		}
+
+		comp := compiler.New()
+		err = comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+	}
+}
+
 func runVmTests(t *testing.T, tests []vmTestCase) {
 	t.Helper()
 
@@ -656,6 +1475,11 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -689,7 +1513,23 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if errObj.Message != expected.Message {
 			t.Errorf("wrong error message. expected=%q, got=%q", expected.Message, errObj.Message)
 		}
+		if expected.Kind != "" && errObj.Kind != expected.Kind {
+			t.Errorf("wrong error kind. expected=%q, got=%q", expected.Kind, errObj.Kind)
+		}
+	}
+}
+
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
 	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
 }
 
 func testIntegerObject(expected int64, actual object.Object) error {